@@ -0,0 +1,138 @@
+/*                                                                           */
+/*  Purpose: Small read-only HTTP endpoint exposing a node's state, so that  */
+/*           tooling on the same host can inspect any node of the ring.      */
+/*                                                                           */
+
+package chord
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+)
+
+/* Reply of /health */
+type HealthStatus struct {
+	Healthy bool              `json:"healthy"`
+	Checks  map[string]string `json:"checks"`
+}
+
+/*
+Start serving the admin endpoint on addr, e.g. "localhost:0" for a random port
+
+GET /status   identity, successor, predecessor, fingers and key count
+GET /fingers  finger table only
+GET /keys     key count
+GET /health   200 when healthy, 503 otherwise
+GET /metrics  Prometheus text format, see WriteMetrics
+
+the listener is kept in node.AdminListener and closed by ShutdownNode.
+*/
+func (node *Node) ServeAdmin(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, r, http.StatusOK, node.localSnapshot())
+	})
+	mux.HandleFunc("/fingers", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, r, http.StatusOK, node.localSnapshot().Fingers)
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, r, http.StatusOK, map[string]int{"count": node.localSnapshot().KeyCount})
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteMetrics(w, node)
+	})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		health := node.health()
+		code := http.StatusOK
+		if !health.Healthy {
+			code = http.StatusServiceUnavailable
+		}
+		writeAdminJSON(w, r, code, health)
+	})
+
+	node.AdminListener = listener
+	go http.Serve(listener, mux)
+	return listener, nil
+}
+
+/* Snapshot of this node built from local state, no RPCs involved */
+func (node *Node) localSnapshot() NodeSnapshot {
+	ns := NodeSnapshot{Id: HashStr(node.Id), Addr: node.Addr}
+	ns.Successor = newNodeRef(node.Successor)
+	ns.Predecessor = newNodeRef(node.Predecessor)
+
+	node.ftLock.RLock()
+	for i, finger := range node.FingerTable {
+		fs := FingerSnapshot{Index: i, Node: newNodeRef(finger.Node)}
+		if finger.Start != nil {
+			fs.Start = HashStr(finger.Start)
+		}
+		ns.Fingers = append(ns.Fingers, fs)
+	}
+	node.ftLock.RUnlock()
+
+	node.dsLock.RLock()
+	ns.KeyCount = len(node.dataStore)
+	node.dsLock.RUnlock()
+	return ns
+}
+
+/*
+a node is healthy when it is not shutting down, knows a successor and
+that successor answers RPCs
+*/
+func (node *Node) health() HealthStatus {
+	health := HealthStatus{true, make(map[string]string)}
+
+	if node.IsShutdown {
+		health.Healthy = false
+		health.Checks["shutdown"] = "node is shutting down"
+	} else {
+		health.Checks["shutdown"] = "ok"
+	}
+
+	succ := node.Successor
+	if succ == nil {
+		health.Healthy = false
+		health.Checks["successor"] = "no successor"
+	} else if EqualIds(succ.Id, node.Id) {
+		health.Checks["successor"] = "ok (only node in ring)"
+	} else if _, err := GetSuccessorId_RPC(succ); err != nil {
+		health.Healthy = false
+		health.Checks["successor"] = "unreachable: " + err.Error()
+	} else {
+		health.Checks["successor"] = "ok"
+	}
+
+	if node.Predecessor == nil {
+		health.Checks["predecessor"] = "unknown"
+	} else {
+		health.Checks["predecessor"] = "ok"
+	}
+	return health
+}
+
+/* Endpoint is read-only, so only GET and HEAD are answered */
+func writeAdminJSON(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "read-only endpoint", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+	w.Write([]byte("\n"))
+}
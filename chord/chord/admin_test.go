@@ -0,0 +1,53 @@
+package chord
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestServeAdmin(t *testing.T) {
+	nodes := newTestRing(t, 40, 160)
+	putOnOwners(nodes, "a", "b", "c")
+	node := nodes[0]
+	listener, err := node.ServeAdmin("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	url := "http://" + listener.Addr().String()
+
+	rsp, err := http.Get(url + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status NodeSnapshot
+	err = json.NewDecoder(rsp.Body).Decode(&status)
+	rsp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Id != HashStr(node.Id) || status.Successor == nil || status.Successor.Id != HashStr(nodes[1].Id) ||
+		status.KeyCount != len(node.dataStore) || len(status.Fingers) != KEY_LENGTH {
+		t.Errorf("status %+v does not describe node %v", status, HashStr(node.Id))
+	}
+
+	if rsp, err := http.Get(url + "/health"); err != nil || rsp.StatusCode != http.StatusOK {
+		t.Errorf("healthy node: %v %v", rsp, err)
+	}
+	if rsp, err := http.Post(url+"/status", "application/json", nil); err != nil || rsp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST to a read-only endpoint: %v %v", rsp, err)
+	}
+
+	// a successor that does not answer makes us unhealthy
+	gone, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone.Close()
+	node.Successor = &RemoteNode{nodes[1].Id, gone.Addr().String()}
+	if rsp, err := http.Get(url + "/health"); err != nil || rsp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("node with a dead successor: %v %v", rsp, err)
+	}
+}
@@ -0,0 +1,199 @@
+/*                                                                           */
+/*  Purpose: Requests signed with an HMAC keyed by a secret shared by the    */
+/*           whole ring, with timestamps and nonces against replays.         */
+/*                                                                           */
+
+package chord
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+/* Requests older or further in the future than this are refused, nonces are kept as long */
+const AUTH_MAX_SKEW = 30 * time.Second
+
+/* Error prefix of requests refused for a missing or bad signature */
+const ERR_UNAUTHENTICATED = "Unauthenticated request"
+
+/* Secrets outgoing connections may sign with, from UseClusterSecret and the nodes of this process */
+var clientSecrets [][]byte
+var clientSecretsLock sync.RWMutex
+
+/*
+Offer secret on every new connection of this process
+
+each connection signs with the secret its server accepts in the handshake,
+or none, so nodes of rings with different secrets can share a process.
+Nodes created with Config.ClusterSecret add theirs themselves. A Client
+outside of any node calls this to reach a ring that requires signatures.
+Cached connections are dropped to be negotiated again.
+*/
+func UseClusterSecret(secret []byte) {
+	addClientSecret(secret)
+	dropCachedClients()
+}
+
+func addClientSecret(secret []byte) {
+	clientSecretsLock.Lock()
+	defer clientSecretsLock.Unlock()
+	for _, known := range clientSecrets {
+		if bytes.Equal(known, secret) {
+			return
+		}
+	}
+	clientSecrets = append(clientSecrets, secret)
+}
+
+/*
+What a new connection tries in turn, nil for unsigned
+
+unsigned first: a ring without secret may not understand a signed request,
+one with a secret refuses an unsigned one cleanly.
+*/
+func clientSecretCandidates() [][]byte {
+	clientSecretsLock.RLock()
+	defer clientSecretsLock.RUnlock()
+	return append([][]byte{nil}, clientSecrets...)
+}
+
+/*
+What a signed request carries instead of its plain body
+
+Payload is the body encoded on its own, gob or JSON after the connection's
+codec, so the MAC covers exactly the bytes the handler will see.
+*/
+type signedBody struct {
+	Payload   []byte
+	Timestamp int64 /* Unix ns when the request was signed */
+	Nonce     []byte
+	MAC       []byte
+}
+
+/* HMAC over the method (which names the target node), time, nonce and payload */
+func requestMAC(secret []byte, serviceMethod string, timestamp int64, nonce []byte, payload []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(timestamp))
+	for _, part := range [][]byte{[]byte(serviceMethod), ts[:], nonce, payload} {
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], uint64(len(part)))
+		mac.Write(n[:])
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+
+/* Client codec signing every request body */
+type authClientCodec struct {
+	rpc.ClientCodec
+	secret []byte
+	wire   WireCodec
+}
+
+func (codec *authClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	payload, err := codec.wire.marshal(body)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	signed := &signedBody{Payload: payload, Timestamp: time.Now().UnixNano(), Nonce: nonce}
+	signed.MAC = requestMAC(codec.secret, r.ServiceMethod, signed.Timestamp, nonce, signed.Payload)
+	return codec.ClientCodec.WriteRequest(r, signed)
+}
+
+/*
+Server codec accepting only requests signed with the node's secret
+
+a request has to be signed within AUTH_MAX_SKEW of our clock and its nonce
+must not have been seen before, which the node remembers for as long.
+Refused requests get an ERR_UNAUTHENTICATED error, the connection stays up.
+*/
+type authServerCodec struct {
+	rpc.ServerCodec
+	node          *Node
+	wire          WireCodec
+	serviceMethod string /* Of the request whose body is read next */
+}
+
+func newAuthServerCodec(node *Node, codec rpc.ServerCodec, wire WireCodec) rpc.ServerCodec {
+	return &authServerCodec{ServerCodec: codec, node: node, wire: wire}
+}
+
+func (codec *authServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := codec.ServerCodec.ReadRequestHeader(r)
+	codec.serviceMethod = r.ServiceMethod
+	return err
+}
+
+func (codec *authServerCodec) ReadRequestBody(body interface{}) error {
+	var signed signedBody
+	if err := codec.ServerCodec.ReadRequestBody(&signed); err != nil {
+		// most likely a peer without the secret sending a plain body
+		return errors.New(fmt.Sprintf("%v: not a signed request: %v", ERR_UNAUTHENTICATED, err))
+	}
+	if body == nil {
+		// net/rpc discarding the body of an unknown method
+		return nil
+	}
+
+	expected := requestMAC(codec.node.config.ClusterSecret, codec.serviceMethod, signed.Timestamp, signed.Nonce, signed.Payload)
+	if !hmac.Equal(signed.MAC, expected) {
+		return errors.New(ERR_UNAUTHENTICATED + ": bad signature")
+	}
+	skew := time.Since(time.Unix(0, signed.Timestamp))
+	if skew > AUTH_MAX_SKEW || skew < -AUTH_MAX_SKEW {
+		return errors.New(fmt.Sprintf("%v: signed %v away from our clock", ERR_UNAUTHENTICATED, skew))
+	}
+	if !codec.node.nonces.add(string(signed.Nonce)) {
+		return errors.New(ERR_UNAUTHENTICATED + ": replayed request")
+	}
+	return codec.wire.unmarshal(signed.Payload, body)
+}
+
+/* Nonces of accepted requests, forgotten once their request would be too old anyway */
+type nonceCache struct {
+	lock   sync.Mutex
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+/* Remember nonce, false if it was already there */
+func (cache *nonceCache) add(nonce string) bool {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	now := time.Now()
+	if cache.seen == nil {
+		cache.seen = make(map[string]time.Time)
+	}
+	if now.Sub(cache.pruned) > AUTH_MAX_SKEW {
+		for n, expires := range cache.seen {
+			if now.After(expires) {
+				delete(cache.seen, n)
+			}
+		}
+		cache.pruned = now
+	}
+	if _, ok := cache.seen[nonce]; ok {
+		return false
+	}
+	// a request is good for AUTH_MAX_SKEW either side of its timestamp
+	cache.seen[nonce] = now.Add(2 * AUTH_MAX_SKEW)
+	return true
+}
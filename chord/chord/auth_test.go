@@ -0,0 +1,58 @@
+package chord
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRequestMACBindsMethodAndNonce(t *testing.T) {
+	secret := []byte("secret")
+	mac := requestMAC(secret, "a:1.Notify_Handler", 1, []byte("n1"), []byte("body"))
+	for _, other := range [][]byte{
+		requestMAC(secret, "b:1.Notify_Handler", 1, []byte("n1"), []byte("body")),
+		requestMAC(secret, "a:1.Notify_Handler", 2, []byte("n1"), []byte("body")),
+		requestMAC(secret, "a:1.Notify_Handler", 1, []byte("n2"), []byte("body")),
+		requestMAC([]byte("other"), "a:1.Notify_Handler", 1, []byte("n1"), []byte("body")),
+	} {
+		if bytes.Equal(mac, other) {
+			t.Errorf("MAC did not change")
+		}
+	}
+
+	var nonces nonceCache
+	if !nonces.add("n1") || nonces.add("n1") || !nonces.add("n2") {
+		t.Errorf("nonce cache let a replay through or refused a new nonce")
+	}
+}
+
+func TestConnectionsPickTheirSecret(t *testing.T) {
+	clientSecretsLock.Lock()
+	saved := clientSecrets
+	clientSecrets = nil
+	clientSecretsLock.Unlock()
+	t.Cleanup(func() {
+		clientSecretsLock.Lock()
+		clientSecrets = saved
+		clientSecretsLock.Unlock()
+	})
+
+	plain := newTestNode(t, []byte{10})
+	ringA := newTestNode(t, []byte{20})
+	ringA.config.ClusterSecret = []byte("secret a")
+	ringB := newTestNode(t, []byte{30})
+	ringB.config.ClusterSecret = []byte("secret b")
+	unknown := newTestNode(t, []byte{40})
+	unknown.config.ClusterSecret = []byte("secret c")
+
+	addClientSecret([]byte("secret a"))
+	UseClusterSecret([]byte("secret b"))
+	for _, node := range []*Node{plain, ringA, ringB} {
+		if err := Ping_RPC(node.RemoteSelf); err != nil {
+			t.Errorf("node %v with secret %q: %v", HashStr(node.Id), node.config.ClusterSecret, err)
+		}
+	}
+	if err := Ping_RPC(unknown.RemoteSelf); err == nil || !strings.Contains(err.Error(), ERR_UNAUTHENTICATED) {
+		t.Errorf("node with a secret we lack: %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+/*                                                                           */
+/*  Purpose: Multi-key Get/Put. Keys are grouped by owning node and every    */
+/*           owner gets one batched RPC, all owners in parallel.             */
+/*                                                                           */
+
+package chord
+
+import (
+	"sync"
+	"time"
+)
+
+/* A key/value pair for PutMany */
+type KeyValue struct {
+	Key   string
+	Value string
+	TTL   time.Duration /* 0 for keys that never expire */
+}
+
+/* Outcome for one key of GetMany/PutMany */
+type KeyResult struct {
+	Key   string
+	Value string /* Value read by GetMany, value written by PutMany */
+	Err   error
+}
+
+/* Get many keys, provided an arbitrary node in the ring. Results are in the order of keys */
+func GetMany(node *Node, keys []string) []KeyResult {
+	return getMany(keys, node.locate)
+}
+
+/* Put many key/values, provided an arbitrary node in the ring. Results are in the order of pairs */
+func PutMany(node *Node, pairs []KeyValue) []KeyResult {
+	return putMany(pairs, node.locate)
+}
+
+/*
+GetMany through the client's routing cache
+
+keys whose owner turned out to be wrong or unreachable are retried one by
+one with Get, which follows redirects and refreshes the cache.
+*/
+func (client *Client) GetMany(keys []string) []KeyResult {
+	results := getMany(keys, client.Lookup)
+	for i := range results {
+		if IsWrongNodeError(results[i].Err) || isTransportError(results[i].Err) {
+			results[i].Value, results[i].Err = client.Get(results[i].Key)
+		}
+	}
+	return results
+}
+
+/* PutMany through the client's routing cache, see GetMany */
+func (client *Client) PutMany(pairs []KeyValue) []KeyResult {
+	results := putMany(pairs, client.Lookup)
+	for i := range results {
+		if IsWrongNodeError(results[i].Err) || isTransportError(results[i].Err) {
+			results[i].Err = client.PutWithTTL(pairs[i].Key, pairs[i].Value, pairs[i].TTL)
+		}
+	}
+	return results
+}
+
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+
+/* Indexes of the keys one owner is responsible for */
+type ownerBatch struct {
+	owner *RemoteNode
+	index []int
+}
+
+/*
+group keys by owner, keys that cannot be located get their error in results
+*/
+func groupByOwner(keys []string, locate func(key string) (*RemoteNode, error), results []KeyResult) []*ownerBatch {
+	byOwner := make(map[string]*ownerBatch)
+	var batches []*ownerBatch
+	for i, key := range keys {
+		results[i].Key = key
+		owner, err := locate(key)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		batch, ok := byOwner[owner.Addr]
+		if !ok {
+			batch = &ownerBatch{owner: owner}
+			byOwner[owner.Addr] = batch
+			batches = append(batches, batch)
+		}
+		batch.index = append(batch.index, i)
+	}
+	return batches
+}
+
+/* Run send for every batch in parallel and copy its results back in place */
+func sendBatches(batches []*ownerBatch, results []KeyResult, send func(batch *ownerBatch) ([]KeyResult, error)) {
+	var wg sync.WaitGroup
+	for _, batch := range batches {
+		wg.Add(1)
+		go func(batch *ownerBatch) {
+			defer wg.Done()
+			batchResults, err := send(batch)
+			for j, i := range batch.index {
+				if err != nil {
+					results[i].Err = err
+				} else {
+					results[i] = batchResults[j]
+				}
+			}
+		}(batch)
+	}
+	wg.Wait()
+}
+
+func getMany(keys []string, locate func(key string) (*RemoteNode, error)) []KeyResult {
+	results := make([]KeyResult, len(keys))
+	batches := groupByOwner(keys, locate, results)
+	sendBatches(batches, results, func(batch *ownerBatch) ([]KeyResult, error) {
+		batchKeys := make([]string, len(batch.index))
+		for j, i := range batch.index {
+			batchKeys[j] = keys[i]
+		}
+		return GetMany_RPC(batch.owner, batchKeys)
+	})
+	return results
+}
+
+func putMany(pairs []KeyValue, locate func(key string) (*RemoteNode, error)) []KeyResult {
+	keys := make([]string, len(pairs))
+	for i, pair := range pairs {
+		keys[i] = pair.Key
+	}
+	results := make([]KeyResult, len(pairs))
+	batches := groupByOwner(keys, locate, results)
+	sendBatches(batches, results, func(batch *ownerBatch) ([]KeyResult, error) {
+		batchPairs := make([]KeyValue, len(batch.index))
+		for j, i := range batch.index {
+			batchPairs[j] = pairs[i]
+		}
+		return PutMany_RPC(batch.owner, batchPairs)
+	})
+	return results
+}
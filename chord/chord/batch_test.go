@@ -0,0 +1,143 @@
+package chord
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+/* Calls of the handler method handled so far by nodes */
+func handledCalls(method string, nodes ...*Node) int {
+	rpcHandledTotal.lock.Lock()
+	defer rpcHandledTotal.lock.Unlock()
+	total := 0.0
+	for _, s := range rpcHandledTotal.series {
+		for _, node := range nodes {
+			if s.values[0] == HashStr(node.Id) && s.values[1] == method {
+				total += s.value
+			}
+		}
+	}
+	return int(total)
+}
+
+func TestGetManyGroupsByOwner(t *testing.T) {
+	nodes := newTestRing(t, 10, 70, 130, 200)
+	var keys []string
+	owners := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		k := fmt.Sprintf("k%v", i)
+		keys = append(keys, k)
+		owners[string(ownerOf(HashKey(k), ringOf(nodes)).Id)] = true
+	}
+	putOnOwners(nodes, keys...)
+
+	before := handledCalls("GetLocalMany_Handler", nodes...)
+	results := GetMany(nodes[0], keys)
+	if batches := handledCalls("GetLocalMany_Handler", nodes...) - before; batches != len(owners) {
+		t.Errorf("%v keys on %v owners sent in %v batches", len(keys), len(owners), batches)
+	}
+	for i, result := range results {
+		if result.Key != keys[i] || result.Value != "v-"+keys[i] || result.Err != nil {
+			t.Errorf("result %v is %+v, want %v", i, result, keys[i])
+		}
+	}
+
+	pairs := make([]KeyValue, len(keys))
+	for i, k := range keys {
+		pairs[i] = KeyValue{Key: k, Value: "new-" + k}
+	}
+	before = handledCalls("PutLocalMany_Handler", nodes...)
+	for i, result := range PutMany(nodes[0], pairs) {
+		if result.Key != keys[i] || result.Err != nil {
+			t.Errorf("put result %v is %+v, want %v", i, result, keys[i])
+		}
+	}
+	if batches := handledCalls("PutLocalMany_Handler", nodes...) - before; batches != len(owners) {
+		t.Errorf("%v pairs on %v owners sent in %v batches", len(pairs), len(owners), batches)
+	}
+	for _, k := range keys {
+		owner := nodeOf(nodes, ownerOf(HashKey(k), ringOf(nodes)))
+		if owner.dataStore[k].Value != "new-"+k {
+			t.Errorf("key %v is %q on its owner %v", k, owner.dataStore[k].Value, HashStr(owner.Id))
+		}
+	}
+}
+
+func TestBatchReportsErrorsPerKey(t *testing.T) {
+	nodes := newTestRing(t, 10, 70, 130, 200)
+	putOnOwners(nodes, "a", "c")
+
+	results := GetMany(nodes[1], []string{"a", "b", "c"})
+	if results[0].Err != nil || results[0].Value != "v-a" || results[2].Err != nil || results[2].Value != "v-c" {
+		t.Errorf("stored keys next to a missing one: %+v", results)
+	}
+	if results[1].Key != "b" || results[1].Err == nil {
+		t.Errorf("missing key got %+v", results[1])
+	}
+
+	results = PutMany(nodes[1], []KeyValue{{"x", "1", 0}, {"y", "2", -time.Second}, {"z", "3", 0}})
+	if results[0].Err != nil || results[2].Err != nil || results[1].Err == nil {
+		t.Errorf("put with one negative TTL: %+v", results)
+	}
+	for _, k := range []string{"x", "y", "z"} {
+		owner := nodeOf(nodes, ownerOf(HashKey(k), ringOf(nodes)))
+		if _, ok := owner.dataStore[k]; ok != (k != "y") {
+			t.Errorf("key %v stored: %v", k, ok)
+		}
+	}
+}
+
+func TestClientBatchFallsBackPerKey(t *testing.T) {
+	nodes := newTestRing(t, 10, 70, 130, 200)
+	var keys []string
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("k%v", i))
+	}
+	putOnOwners(nodes, keys...)
+	client := NewClient(nodes[0].RemoteSelf)
+
+	// (70, 130] cached as owned by a node that is gone, its batch fails as a whole
+	gone, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone.Close()
+	client.routes[string(nodes[2].Id)] = routeEntry{nodes[1].Id, &RemoteNode{nodes[2].Id, gone.Addr().String()}}
+	inRange := keyIn(t, 70, 130, "")
+
+	for i, result := range client.GetMany(keys) {
+		if result.Key != keys[i] || result.Value != "v-"+keys[i] || result.Err != nil {
+			t.Errorf("result %v is %+v, want %v", i, result, keys[i])
+		}
+	}
+	if owner := client.cachedOwner(HashKey(inRange)); owner == nil || owner.Addr != nodes[2].Addr {
+		t.Errorf("range of the gone node not replaced after the fallback: %v", owner)
+	}
+
+	// 100 joins and takes (70, 100] from 130, which redirects keys of the batch sent to it
+	joined := newTestNode(t, []byte{100})
+	joined.Predecessor = nodes[1].RemoteSelf
+	joined.Successor = nodes[2].RemoteSelf
+	nodes[2].ftLock.Lock()
+	nodes[2].Predecessor = joined.RemoteSelf
+	nodes[2].ftLock.Unlock()
+	moved := keyIn(t, 70, 100, "")
+
+	pairs := make([]KeyValue, len(keys))
+	for i, k := range keys {
+		pairs[i] = KeyValue{Key: k, Value: "new-" + k}
+	}
+	for i, result := range client.PutMany(pairs) {
+		if result.Err != nil {
+			t.Errorf("put of %v failed: %v", pairs[i].Key, result.Err)
+		}
+	}
+	if joined.dataStore[moved].Value != "new-"+moved {
+		t.Errorf("redirected key %v is %q on the new owner", moved, joined.dataStore[moved].Value)
+	}
+	if nodes[2].dataStore[moved].Value != "v-"+moved {
+		t.Errorf("redirected key %v overwritten on the old owner", moved)
+	}
+}
@@ -0,0 +1,229 @@
+/*                                                                           */
+/*  Purpose: Ring consistency checker. Walks a running ring through RPCs and */
+/*           reports every pointer, finger or key that is out of place.      */
+/*                                                                           */
+
+package chord
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+/* Kinds of violation reported by CheckRing */
+const (
+	VIOLATION_UNREACHABLE = "unreachable" /* node did not answer an RPC */
+	VIOLATION_RING        = "ring"        /* successor chain does not close back on itself */
+	VIOLATION_PREDECESSOR = "predecessor" /* succ(n).pred != n */
+	VIOLATION_FINGER      = "finger"      /* finger does not point at successor(start) */
+	VIOLATION_KEY         = "key"         /* key is stored on a node that does not own it */
+)
+
+/* Upper bound on successor hops when walking a ring, guards against broken chains. A var for tests */
+var MAX_RING_WALK = 1 << 16
+
+/* A single inconsistency found while checking the ring */
+type Violation struct {
+	Kind   string      /* One of the VIOLATION_* constants */
+	Node   *RemoteNode /* Node the violation was observed on */
+	Detail string      /* Human readable description */
+}
+
+/* Result of CheckRing */
+type RingReport struct {
+	Nodes      []*RemoteNode /* Nodes in the order they were walked */
+	Closed     bool          /* Successor chain came back to the first node */
+	Violations []Violation   /* Everything that looked wrong */
+}
+
+/* True when no violation was found */
+func (report *RingReport) Ok() bool {
+	return len(report.Violations) == 0
+}
+
+func (report *RingReport) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "ring of %v nodes, %v violations\n", len(report.Nodes), len(report.Violations))
+	for _, v := range report.Violations {
+		fmt.Fprintf(&buf, "\t[%v] %v %v: %v\n", v.Kind, HashStr(v.Node.Id), v.Node.Addr, v.Detail)
+	}
+	return buf.String()
+}
+
+func (report *RingReport) add(kind string, node *RemoteNode, format string, args ...interface{}) {
+	report.Violations = append(report.Violations, Violation{kind, node, fmt.Sprintf(format, args...)})
+}
+
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+
+/*
+Walk the ring starting at start and check it is consistent
+
+1. hop GetSuccessorId_RPC until we are back at start == ring membership
+2. succ(n).pred must be n for every n
+3. every finger entry must point at the true successor of its start, and
+   finger 0 at the node's successor
+4. every key must sit on the node that owns its hash
+
+the true successor of an id is computed from the membership found in step 1,
+so the checker does not trust any finger table while checking them. If the
+walk was cut short, only ids up to the last node reached are checked.
+An error is only returned when start itself cannot be reached.
+*/
+func CheckRing(start *RemoteNode) (*RingReport, error) {
+	report := new(RingReport)
+	nodes, err := walkRing(start, report)
+	if err != nil {
+		return nil, err
+	}
+	report.Nodes = nodes
+	sorted := sortedRing(nodes)
+
+	// a partial walk says nothing about the arc from its last node back to start
+	known := func(id []byte) bool {
+		return report.Closed || BetweenRightIncl(id, nodes[0].Id, nodes[len(nodes)-1].Id)
+	}
+
+	// 2. successor and predecessor pointers agree
+	for i, n := range nodes {
+		if i == len(nodes)-1 && !report.Closed {
+			break
+		}
+		succ := nodes[(i+1)%len(nodes)]
+		pred, err := GetPredecessorId_RPC(succ)
+		if err != nil {
+			report.add(VIOLATION_UNREACHABLE, succ, "GetPredecessorId_RPC: %v", err)
+		} else if pred == nil {
+			report.add(VIOLATION_PREDECESSOR, succ, "has no predecessor, expected %v", HashStr(n.Id))
+		} else if !EqualIds(pred.Id, n.Id) {
+			report.add(VIOLATION_PREDECESSOR, succ, "predecessor is %v, expected %v", HashStr(pred.Id), HashStr(n.Id))
+		}
+	}
+
+	for i, n := range nodes {
+		// 3. fingers point at successor(start), finger 0 is the successor pointer
+		fingers, err := GetFingerTable_RPC(n)
+		if err != nil {
+			report.add(VIOLATION_UNREACHABLE, n, "GetFingerTable_RPC: %v", err)
+		}
+		if len(fingers) > 0 && (i < len(nodes)-1 || report.Closed) {
+			succ := nodes[(i+1)%len(nodes)]
+			if fingers[0].Node == nil || !EqualIds(fingers[0].Node.Id, succ.Id) {
+				report.add(VIOLATION_FINGER, n, "finger 0 is %v, successor is %v",
+					describeNode(fingers[0].Node), HashStr(succ.Id))
+			}
+		}
+		for i, finger := range fingers {
+			if finger.Start == nil || !known(finger.Start) {
+				continue
+			}
+			owner := ownerOf(finger.Start, sorted)
+			if finger.Node == nil {
+				report.add(VIOLATION_FINGER, n, "finger %v (start %v) is empty, expected %v",
+					i, HashStr(finger.Start), HashStr(owner.Id))
+			} else if !EqualIds(finger.Node.Id, owner.Id) {
+				report.add(VIOLATION_FINGER, n, "finger %v (start %v) points at %v, expected %v",
+					i, HashStr(finger.Start), HashStr(finger.Node.Id), HashStr(owner.Id))
+			}
+		}
+
+		// 4. keys live on their owner
+		keys, err := GetKeys_RPC(n)
+		if err != nil {
+			report.add(VIOLATION_UNREACHABLE, n, "GetKeys_RPC: %v", err)
+		}
+		for _, k := range keys {
+			if !known(HashKey(k)) {
+				continue
+			}
+			owner := ownerOf(HashKey(k), sorted)
+			if !EqualIds(owner.Id, n.Id) {
+				report.add(VIOLATION_KEY, n, "key %q (hash %v) belongs to %v",
+					k, HashStr(HashKey(k)), HashStr(owner.Id))
+			}
+		}
+	}
+
+	return report, nil
+}
+
+/*
+hop successors from start until we come back to start
+
+nodes are returned in ring order, starting with start. A chain that loops
+without passing start again, or that dead-ends, is recorded in report.
+*/
+func walkRing(start *RemoteNode, report *RingReport) ([]*RemoteNode, error) {
+	if start == nil {
+		return nil, errors.New("RemoteNode is empty!")
+	}
+	if _, err := GetSuccessorId_RPC(start); err != nil {
+		return nil, err
+	}
+
+	nodes := []*RemoteNode{start}
+	seen := map[string]bool{string(start.Id): true}
+	cur := start
+	for i := 0; i < MAX_RING_WALK; i++ {
+		succ, err := GetSuccessorId_RPC(cur)
+		if err != nil {
+			report.add(VIOLATION_UNREACHABLE, cur, "GetSuccessorId_RPC: %v", err)
+			return nodes, nil
+		}
+		if succ.Id == nil {
+			report.add(VIOLATION_RING, cur, "has no successor")
+			return nodes, nil
+		}
+		if EqualIds(succ.Id, start.Id) {
+			report.Closed = true
+			return nodes, nil
+		}
+		if seen[string(succ.Id)] {
+			report.add(VIOLATION_RING, cur, "successor %v loops back without reaching %v",
+				HashStr(succ.Id), HashStr(start.Id))
+			return nodes, nil
+		}
+		seen[string(succ.Id)] = true
+		nodes = append(nodes, succ)
+		cur = succ
+	}
+	report.add(VIOLATION_RING, cur, "gave up after %v successor hops", MAX_RING_WALK)
+	return nodes, nil
+}
+
+/* ID of n for reports, "empty" for nil */
+func describeNode(n *RemoteNode) string {
+	if n == nil {
+		return "empty"
+	}
+	return HashStr(n.Id)
+}
+
+/* Copy of nodes sorted by ID */
+func sortedRing(nodes []*RemoteNode) []*RemoteNode {
+	sorted := make([]*RemoteNode, len(nodes))
+	copy(sorted, nodes)
+	sort.Slice(sorted, func(i, j int) bool {
+		a := new(big.Int).SetBytes(sorted[i].Id)
+		b := new(big.Int).SetBytes(sorted[j].Id)
+		return a.Cmp(b) < 0
+	})
+	return sorted
+}
+
+/* First node clockwise from id, i.e. the node responsible for id. sorted must be non-empty */
+func ownerOf(id []byte, sorted []*RemoteNode) *RemoteNode {
+	for i, n := range sorted {
+		prev := sorted[(i+len(sorted)-1)%len(sorted)]
+		if BetweenRightIncl(id, prev.Id, n.Id) {
+			return n
+		}
+	}
+	return sorted[0]
+}
@@ -0,0 +1,155 @@
+package chord
+
+import (
+	"math/big"
+	"net"
+	"net/rpc"
+	"sort"
+	"strings"
+	"testing"
+)
+
+/*
+Nodes with the given IDs serving RPCs on localhost, wired into a correct ring
+
+none of the background threads run, so nothing changes unless the test
+changes it. The nodes stop serving when the test ends.
+*/
+func newTestRing(t *testing.T, ids ...byte) []*Node {
+	nodes := make([]*Node, len(ids))
+	for i, id := range ids {
+		nodes[i] = newTestNode(t, []byte{id})
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return new(big.Int).SetBytes(nodes[i].Id).Cmp(new(big.Int).SetBytes(nodes[j].Id)) < 0
+	})
+	remotes := make([]*RemoteNode, len(nodes))
+	for i, node := range nodes {
+		remotes[i] = node.RemoteSelf
+	}
+	for i, node := range nodes {
+		node.Successor = remotes[(i+1)%len(nodes)]
+		node.Predecessor = remotes[(i+len(nodes)-1)%len(nodes)]
+		for j := range node.FingerTable {
+			node.FingerTable[j].Node = ownerOf(node.FingerTable[j].Start, remotes)
+		}
+	}
+	return nodes
+}
+
+func newTestNode(t *testing.T, id []byte) *Node {
+	config := DefaultConfig()
+	config.Logger = NopLogger()
+	node := &Node{Id: id, config: config, log: config.Logger}
+	// RPC services are registered process wide by address and never removed,
+	// a port freed by an earlier test would still be served by its old node
+	var taken []net.Listener
+	for node.Listener == nil {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rpc.RegisterName(listener.Addr().String(), node) != nil {
+			taken = append(taken, listener)
+			continue
+		}
+		node.Listener = listener
+		node.Addr = listener.Addr().String()
+	}
+	for _, listener := range taken {
+		listener.Close()
+	}
+	node.dataStore = make(map[string]dataEntry)
+	node.replicaStore = make(map[string]dataEntry)
+	node.watches = make(map[string]*subscription)
+	node.load = newLoadLimiter(config)
+	node.stabilizeInterval = newAdaptiveInterval(config.StabilizeMinInterval, config.StabilizeMaxInterval)
+	node.fingerInterval = newAdaptiveInterval(config.FixFingersMinInterval, config.FixFingersMaxInterval)
+	node.RemoteSelf = &RemoteNode{node.Id, node.Addr}
+	node.initFingerTable()
+	go node.startRpcServer()
+	t.Cleanup(func() {
+		node.IsShutdown = true
+		node.Listener.Close()
+		// a later node may get the same port, it must not reach us through a cached client
+		connLock.Lock()
+		if client, ok := connMap[node.Addr]; ok {
+			client.Close()
+			delete(connMap, node.Addr)
+		}
+		connLock.Unlock()
+	})
+	return node
+}
+
+/* Store every key on the node of nodes that owns it */
+func putOnOwners(nodes []*Node, keys ...string) {
+	remotes := make([]*RemoteNode, len(nodes))
+	for i, node := range nodes {
+		remotes[i] = node.RemoteSelf
+	}
+	for _, k := range keys {
+		owner := ownerOf(HashKey(k), sortedRing(remotes))
+		for _, node := range nodes {
+			if EqualIds(node.Id, owner.Id) {
+				node.dataStore[k] = newDataEntry("v-"+k, 0)
+			}
+		}
+	}
+}
+
+func TestCheckRing(t *testing.T) {
+	nodes := newTestRing(t, 10, 70, 130, 200)
+	putOnOwners(nodes, "a", "b", "c", "d", "e", "f", "g", "h")
+
+	report, err := CheckRing(nodes[1].RemoteSelf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Ok() || !report.Closed || len(report.Nodes) != 4 {
+		t.Fatalf("correct ring reported as %v", report)
+	}
+
+	// finger 0 disagreeing with the successor pointer
+	nodes[2].FingerTable[0].Node = nodes[0].RemoteSelf
+	// a key on the node after the one that owns it
+	for i, node := range nodes {
+		if _, ok := node.dataStore["a"]; ok {
+			nodes[(i+1)%len(nodes)].dataStore["a"] = node.dataStore["a"]
+			delete(node.dataStore, "a")
+			break
+		}
+	}
+	report, err = CheckRing(nodes[0].RemoteSelf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := map[string]bool{}
+	successorDetail := false
+	for _, v := range report.Violations {
+		kinds[v.Kind] = true
+		successorDetail = successorDetail || strings.Contains(v.Detail, "successor is")
+	}
+	if !kinds[VIOLATION_FINGER] || !successorDetail || !kinds[VIOLATION_KEY] {
+		t.Errorf("broken finger 0 and stray key not both reported: %v", report)
+	}
+}
+
+func TestCheckRingTruncatedWalk(t *testing.T) {
+	nodes := newTestRing(t, 10, 70, 130, 200)
+	putOnOwners(nodes, "a", "b", "c", "d", "e", "f", "g", "h")
+
+	defer func(max int) { MAX_RING_WALK = max }(MAX_RING_WALK)
+	MAX_RING_WALK = 2
+	report, err := CheckRing(nodes[0].RemoteSelf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Closed || len(report.Nodes) != 3 {
+		t.Fatalf("walk of 2 hops closed=%v with %v nodes", report.Closed, len(report.Nodes))
+	}
+	// only the cut itself, nothing about the arc the walk never reached
+	if len(report.Violations) != 1 || report.Violations[0].Kind != VIOLATION_RING {
+		t.Errorf("truncated walk reported %v", report)
+	}
+}
@@ -17,8 +17,9 @@ package chord
 
 import (
 	"../../cs138"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	"log"
 	"net"
 	"net/rpc"
 	"sync"
@@ -28,13 +29,11 @@ import (
 // Number of bits (i.e. M value), assumes <= 128 and divisible by 8
 const KEY_LENGTH = 8
 
-// Turn debug-mode printing on/off
-const DEBUG = false
-
 /* A single finger table entry */
 type FingerEntry struct {
 	Start []byte       /* ID hash of (n + 2^i) mod (2^m)  */
 	Node  *RemoteNode  /* RemoteNode that Start points to */
+	candidates []*RemoteNode /* Nodes up to the next Start, lookups may hop to any. Only with Config.FingerCandidates > 1 */
 }
 
 /* Non-local node representation */
@@ -57,8 +56,19 @@ type Node struct {
 	IsShutdown  bool              /* Is node in process of shutting down? */
 	FingerTable []FingerEntry     /* Finger table entries */
 	ftLock      sync.RWMutex      /* RWLock for finger table */
-	dataStore   map[string]string /* Local datastore for this node */
+	dataStore   map[string]dataEntry /* Local datastore for this node */
 	dsLock      sync.RWMutex      /* RWLock for datastore */
+	replicaStore map[string]dataEntry /* Copies of our predecessors' keys, also under dsLock */
+	AdminListener net.Listener    /* HTTP status endpoint listener, nil unless ServeAdmin was called */
+	watches     map[string]*subscription /* Key and prefix watches registered on us, by id */
+	watchLock   sync.Mutex        /* Lock for watches */
+	nonces      nonceCache        /* Nonces of recent signed requests, against replays */
+	load        *loadLimiter      /* Connections and requests we are serving, against config limits */
+	stabilizeInterval *adaptiveInterval /* Wait between stabilize rounds */
+	fingerInterval *adaptiveInterval /* Wait between fix finger rounds */
+	rtts        rttTable          /* Round trip times to finger candidates */
+	config      *Config           /* Settings this node was created with */
+	log         Logger            /* config.Logger tagged with our ID and address */
 }
 
 
@@ -81,9 +91,15 @@ creating and shutting down nodes
 
 Initailize a Chord node, start listener, rpc server, and go routines 
 */
-func (node *Node) init(parent *RemoteNode, definedId []byte) error {
+func (node *Node) init(parent *RemoteNode, definedId []byte, config *Config) error {
 	if KEY_LENGTH > 128 || KEY_LENGTH%8 != 0 {
-		log.Fatal(fmt.Sprintf("KEY_LENGTH of %v is not supported! Must be <= 128 and divisible by 8", KEY_LENGTH))
+		return fmt.Errorf("KEY_LENGTH of %v is not supported! Must be <= 128 and divisible by 8", KEY_LENGTH)
+	}
+	if config == nil {
+		config = DefaultConfig()
+	}
+	if config.Logger == nil {
+		config.Logger = NopLogger()
 	}
 
 	// 1. init chord node 
@@ -91,22 +107,47 @@ func (node *Node) init(parent *RemoteNode, definedId []byte) error {
 	if err != nil {
 		return err
 	}
-	node.Id = HashKey(listener.Addr().String())
-	if definedId != nil {
-		node.Id = definedId
+	var tlsConfig *tls.Config
+	var cert *x509.Certificate
+	if config.TLS != nil {
+		if tlsConfig, cert, err = loadTLS(config.TLS); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	node.Id, err = chooseId(listener.Addr().String(), definedId, config.IdScheme, cert)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+		setClientTLS(tlsConfig, false)
+	}
+	if config.ClusterSecret != nil {
+		addClientSecret(config.ClusterSecret)
 	}
 	node.Listener = listener
 	node.Addr = listener.Addr().String()
+	node.config = config
+	node.log = config.Logger.With("node", HashStr(node.Id), "addr", node.Addr)
 	node.IsShutdown = false
-	node.dataStore = make(map[string]string)
+	node.dataStore = make(map[string]dataEntry)
+	node.replicaStore = make(map[string]dataEntry)
+	node.watches = make(map[string]*subscription)
+	node.load = newLoadLimiter(config)
+	node.stabilizeInterval = newAdaptiveInterval(config.StabilizeMinInterval, config.StabilizeMaxInterval)
+	node.fingerInterval = newAdaptiveInterval(config.FixFingersMinInterval, config.FixFingersMaxInterval)
 	node.RemoteSelf = new(RemoteNode) // RemoteNode that points to yourself
 	node.RemoteSelf.Id = node.Id
 	node.RemoteSelf.Addr = node.Addr	
+	// the table has to exist before join fills it in
+	node.initFingerTable()
 	err = node.join(parent) // "join" packet == Join this node to the same chord ring as parent
 	if err != nil {
 		return err
 	}
-	node.initFingerTable()
+	node.log.Info("node started", "succ", HashStr(node.Successor.Id))
 
 	// 2. 3 threads == all run periodically 
 	// Thread 1: listening for all types of incoming packets 
@@ -114,12 +155,19 @@ func (node *Node) init(parent *RemoteNode, definedId []byte) error {
 	go node.startRpcServer()
 
 	// Thread 2: "stabilize/notify" packet == fresh immediate predecessor n successor 
-	ticker1 := time.NewTicker(time.Millisecond * 100)
-	go node.stabilize(ticker1)
+	// both intervals back off while nothing changes, see churn.go
+	go node.stabilize()
 
 	// Thread 3: "find immediate successor for every entry" packet == fresh finger table
-	ticker2 := time.NewTicker(time.Millisecond * 90)
-	go node.fixNextFinger(ticker2)
+	go node.fixNextFinger()
+
+	// Thread 4: drop keys whose TTL ran out
+	go node.sweepExpired(time.NewTicker(config.ExpirySweepInterval))
+
+	// Thread 5: keep replicas of our keys on the next successors in sync
+	if config.Replicas > 1 {
+		go node.antiEntropy(time.NewTicker(config.AntiEntropyInterval))
+	}
 
 	return err
 }
@@ -129,13 +177,18 @@ func (node *Node) init(parent *RemoteNode, definedId []byte) error {
 func (node *Node) startRpcServer() {
 	for {
 		if node.IsShutdown {
-			fmt.Printf("[%v] Shutting down RPC server\n", HashStr(node.Id))
+			node.log.Info("shutting down RPC server")
 			return
 		}
 		if conn, err := node.Listener.Accept(); err != nil {
-			log.Fatal("accept error: " + err.Error())
+			if node.IsShutdown {
+				continue
+			}
+			// listener is gone, nothing more we can serve
+			node.log.Error("accept error, stopping RPC server", "err", err)
+			return
 		} else {
-			go rpc.ServeConn(conn)
+			go node.serveConn(conn)
 		}
 	}
 }
@@ -156,7 +209,7 @@ func (node *Node) initFingerTable() {
 	node.FingerTable = make([]FingerEntry, KEY_LENGTH) 
 
 	// all entries init to point to itself
-	for i := 1; i < KEY_LENGTH; i+=1 {
+	for i := 0; i < KEY_LENGTH; i+=1 {
 		node.ftLock.Lock()
 		node.FingerTable[i].Start = fingerMath(node.Id, i, KEY_LENGTH)
 		node.FingerTable[i].Node = node.RemoteSelf
@@ -170,33 +223,81 @@ func (node *Node) initFingerTable() {
 /* 
 periodically update finger table entries to keep it always fresh
 
+chord paper figure 6 fix_fingers: one entry per tick, round robin
+
 1. compute 1st column "start" in finger table
 2. rpc recursion to find successor node for key "start"
 3. fill 3rd column "successor" in finger table
 
+ftLock is only held to read and write the entry, never across an rpc.
+the interval backs off after a full pass that changed nothing.
 */
-func (node *Node) fixNextFinger(ticker *time.Ticker) {
-
-	for _ = range ticker.C {
-		// 1. find every finger table entry's successor node
-		for i := 0; i < KEY_LENGTH; i+=1 {
-			// // 1.1 optimized: if start smaller than previous entry's successor
-			// // 2 table entries share same successor == no need to rpc
-			// if node.FingerTable[i].Start < node.FingerTable[i-1].node {
-			// 	continue
-			
-			// 1.2 normal case: recursively
-			// }else{
+func (node *Node) fixNextFinger() {
+
+	next := 0
+	passChanged := false
+	for {
+		node.fingerInterval.wait()
+		if node.IsShutdown {
+			node.log.Info("shutting down fix finger timer")
+			return
+		}
+
+		// 1. start of the entry, and the previous entry's node if it covers it
+		node.ftLock.RLock()
+		start := node.FingerTable[next].Start
+		each_entry_successor := node.reusableFinger(next)
+		node.ftLock.RUnlock()
+
+		// 2. otherwise recursively, without the lock
+		var err error
+		if each_entry_successor == nil {
+			each_entry_successor, err = node.find_closest_successor(start)
+		}
 
+		// 3. keep the old entry if the lookup failed
+		changed := false
+		if err != nil || each_entry_successor == nil {
+			node.log.Debug("fix finger failed", "finger", next, "err", err)
+		} else if node.acceptFinger(each_entry_successor) {
+			// proximity mode: more nodes of the interval to pick from by RTT
+			var candidates []*RemoteNode
+			if node.config.FingerCandidates > 1 {
+				candidates = node.fingerCandidates(next, each_entry_successor)
+			}
 			node.ftLock.Lock()
-			each_entry_successor, err := node.find_closest_successor(node.FingerTable[i].Start)
-			node.FingerTable[i].Node = each_entry_successor
+			changed = !sameNode(node.FingerTable[next].Node, each_entry_successor)
+			node.FingerTable[next].Node = each_entry_successor
+			node.FingerTable[next].candidates = candidates
 			node.ftLock.Unlock()
-			
+		}
+
+		passChanged = passChanged || changed
+		next = (next + 1) % KEY_LENGTH
+		if changed {
+			node.fingerInterval.next(true)
+		} else if next == 0 {
+			node.fingerInterval.next(passChanged)
+			passChanged = false
 		}
 	}
 }
 
+/*
+Node of finger i-1 if finger i's start falls before it, so no lookup is
+needed. Caller holds ftLock
+*/
+func (node *Node) reusableFinger(i int) *RemoteNode {
+	if i == 0 {
+		return nil
+	}
+	previous := node.FingerTable[i-1].Node
+	if previous != nil && BetweenRightIncl(node.FingerTable[i].Start, node.Id, previous.Id) {
+		return previous
+	}
+	return nil
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////
 ////////////////////////////////////////////////////////////////////////////////////////
 ////////////////////////////////////////////////////////////////////////////////////////
@@ -221,23 +322,30 @@ NOTE:
 - stabilize == notify
 - notify == being stabilized == "stabilize" packets handler 
 */
-func (node *Node) stabilize(ticker *time.Ticker) {
-	for _ = range ticker.C {
+func (node *Node) stabilize() {
+	var lastSucc, lastPred []byte
+	for {
+		node.stabilizeInterval.wait()
 		if node.IsShutdown {
-			fmt.Printf("[%v-stabilize] Shutting down stabilize timer\n", HashStr(node.Id))
-			ticker.Stop()
+			node.log.Info("shutting down stabilize timer")
 			return
 		}
+		start := time.Now()
 
 		// 1. check if there is new node, if yes update new node as my new immediate successor
 		// i ask my immediate successor for its immediate predecessor to see if its still me
 		// my_successor_predecessor == might be new node in btwn me n my successor == my new successor 
 		my_successor_predecessor, err := GetPredecessorId_RPC(node.Successor)
 		if err != nil {
-			log.Fatal("stabilize() GetPredecessorId_RPC() error: " + err.Error())
+			// successor unreachable this round, try again on the next tick
+			node.log.Warn("stabilize: GetPredecessorId_RPC failed", "succ", node.Successor.Addr, "err", err)
+			node.stabilizeInterval.next(true)
+			continue
 		}
 			
-		if BetweenRightIncl(my_successor_predecessor.Id, node.Id, node.Successor.Id) && my_successor_predecessor != nil {
+		if my_successor_predecessor != nil && BetweenRightIncl(my_successor_predecessor.Id, node.Id, node.Successor.Id) &&
+			node.acceptFinger(my_successor_predecessor) {
+			node.log.Debug("stabilize: new successor", "succ", HashStr(my_successor_predecessor.Id))
 			node.ftLock.Lock()
 			node.Successor = my_successor_predecessor
 			node.FingerTable[0].Node = my_successor_predecessor
@@ -251,6 +359,16 @@ func (node *Node) stabilize(ticker *time.Ticker) {
 		if !EqualIds(node.Successor.Id, node.Id) { // if you are your own successor, do not notify yourself
 			Notify_RPC(node.Successor, node.RemoteSelf)
 		}
+		stabilizeSeconds.observeSince(start, HashStr(node.Id))
+
+		// a new neighbour on either side, ours or told by a notify, is churn
+		succ, pred := node.neighbours()
+		changed := !EqualIds(succ, lastSucc) || !EqualIds(pred, lastPred)
+		lastSucc, lastPred = succ, pred
+		node.stabilizeInterval.next(changed)
+		if changed {
+			node.fingerInterval.reset()
+		}
 	}
 }
 
@@ -276,20 +394,27 @@ func (node *Node) notify(new_predecessor *RemoteNode) {
 	// 1. update predecessor remote node to be my new predecessor (if we are new node successor)
 	// - if predecessor who sent me this is in between me and my existing predecessor 
 	// - or i dont even have a predecessor (new node)
-	if Between(new_predecessor.Id, node.Predecessor.Id, node.Id) || node.Predecessor == nil {
-		node.Predecessor = new_predecessor		
+	node.ftLock.Lock()
+	old_predecessor := node.Predecessor
+	if old_predecessor != nil && !Between(new_predecessor.Id, old_predecessor.Id, node.Id) {
+		node.ftLock.Unlock()
+		return
 	}
+	node.Predecessor = new_predecessor
+	node.ftLock.Unlock()
+	node.log.Debug("notify: new predecessor", "pred", HashStr(new_predecessor.Id))
+	node.noteChurn()
 	
 	// 2. we as successor transfer predecessor data belongs to him (successor -> predecessor)
-	// node.RemoteSelf == where to rpc to 
-	// new_predecessor == where to send data to 
-	// == where to send data to 
-	TransferKeys_RPC(node.RemoteSelf, node.RemoteSelf, new_predecessor.Id)
+	// == keys in (old predecessor, new predecessor], without an old one
+	// everything outside (new predecessor, us]
+	from := node.Id
+	if old_predecessor != nil {
+		from = old_predecessor.Id
+	}
+	node.transferKeys(from, new_predecessor.Id, new_predecessor)
 }
 
-
-
-
 ////////////////////////////////////////////////////////////////////////////////////////
 ////////////////////////////////////////////////////////////////////////////////////////
 ////////////////////////////////////////////////////////////////////////////////////////
@@ -311,6 +436,8 @@ NOTE:
 	- only need successor to start "stabilize" 
 	- could have empty finger table, empty predecessor, empty data 
 - then uses "stabilize" + "notify" + "fixNextFinger" to seed its predecessor + data + finger table
+- to be routable right away we also bootstrap the finger table from the
+  successor's, see bootstrapFingers. The predecessor still comes from notify
 */
 func (node *Node) join(random_node *RemoteNode) error {
 
@@ -318,31 +445,112 @@ func (node *Node) join(random_node *RemoteNode) error {
 	if random_node != nil { // there is any random node in an existing ring 
 		// 1. ask any random node to hop its his finger table to find new node's immediate successor 
 		succ, err := FindSuccessor_RPC(random_node, node.Id)
+		if err == nil {
+			err = node.checkPeerId(succ)
+		}
+		if err != nil {
+			return err
+		}
 		
 		// 2. u() new node's immediate successor 
 		node.ftLock.Lock()
 		node.Successor = succ
 		node.FingerTable[0].Node = succ
 		node.ftLock.Unlock()
+
+		// 3. rest of the finger table in one round
+		// (the paper's init_finger_table, other nodes learn of us through stabilize)
+		node.bootstrapFingers(succ)
 	}else{ // you are the only node 
 		return nil 
 	}
 
-		// // 1. init your own finger table 
-		// initFingerTable(node)
+	return nil
+}
 
-		// // 2. update predecessors to see if new node is their new successor 
-		// update_others()
 
-		// // 3. all table entries are just yourself
-		// for (i = 1, i < KEY_LENGTH, i++) {
-		// 	node.FingerTable[0].Node.Id = node.Id 
-		// 	node.FingerTable[0].Node.Addr = node.Addr
-		// }
-		
-		// node.predecessor.Id = node.Id 
-		// node.predecessor.Node.Addr = node.Addr
-	return nil
+/*
+Fill the finger table in one round instead of one finger per tick
+
+the successor's fingers and predecessor are the starting guess, then every
+entry is looked up starting at its guess, all at once. A failed lookup keeps
+the guess for fixNextFinger to correct. Predecessor is left to notify, it
+is only ours once it notifies us itself.
+*/
+func (node *Node) bootstrapFingers(succ *RemoteNode) {
+	known := []*RemoteNode{node.RemoteSelf, succ}
+	if fingers, err := GetFingerTable_RPC(succ); err != nil {
+		node.log.Warn("join: no finger table from successor", "succ", succ.Addr, "err", err)
+	} else {
+		for _, finger := range fingers {
+			known = append(known, finger.Node)
+		}
+	}
+	// the successor's predecessor will be ours if we sit between them, a guess for the far fingers
+	pred, err := GetPredecessorId_RPC(succ)
+	if err == nil && pred != nil && !EqualIds(pred.Id, node.Id) && Between(node.Id, pred.Id, succ.Id) &&
+		node.checkPeerId(pred) == nil {
+		known = append(known, pred)
+	}
+
+	node.ftLock.Lock()
+	guessFingers(node.FingerTable[1:], known)
+	guesses := make([]FingerEntry, len(node.FingerTable))
+	copy(guesses, node.FingerTable)
+	node.ftLock.Unlock()
+
+	// finger 0 is succ already
+	found := make([]*RemoteNode, len(guesses))
+	var wg sync.WaitGroup
+	for i := 1; i < len(guesses); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// our own RPC server isn't up yet
+			entry := guesses[i].Node
+			if entry == nil || EqualIds(entry.Id, node.Id) {
+				entry = succ
+			}
+			finger, err := FindSuccessor_RPC(entry, guesses[i].Start)
+			if err != nil || finger == nil || finger.Addr == "" {
+				node.log.Debug("join: finger lookup failed", "finger", i, "err", err)
+				return
+			}
+			if node.acceptFinger(finger) {
+				found[i] = finger
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	node.ftLock.Lock()
+	for i, finger := range found {
+		if finger != nil {
+			node.FingerTable[i].Node = finger
+		}
+	}
+	node.ftLock.Unlock()
+}
+
+
+/* Point every finger at the first of known at or after its start */
+func guessFingers(fingers []FingerEntry, known []*RemoteNode) {
+	for i := range fingers {
+		start := fingers[i].Start
+		var best *RemoteNode
+		for _, candidate := range known {
+			if candidate == nil || candidate.Id == nil {
+				continue
+			}
+			if best == nil || EqualIds(candidate.Id, start) ||
+				(!EqualIds(best.Id, start) && !EqualIds(candidate.Id, best.Id) && Between(candidate.Id, start, best.Id)) {
+				best = candidate
+			}
+		}
+		if best != nil {
+			fingers[i].Node = best
+		}
+	}
 }
 
 
@@ -408,21 +616,25 @@ func (node *Node) find_closest_successor(id []byte) (*RemoteNode, error) {
 	
 	// 1. break condition of distributed recursion -> 
 	// this condition is true only on immediate_predecessor node
-	if BetweenRightIncl(id, node.Id, node.Successor.Id) ||
-		EqualIds(node.Successor.Id, node.Id) {
+	node.ftLock.RLock()
+	successor := node.Successor
+	node.ftLock.RUnlock()
+	if BetweenRightIncl(id, node.Id, successor.Id) {
 
 		// immediate_predecessor's old immediate_successor == new node's successor	
-		return node.Successor, nil
+		return successor, nil
 	}
 
 	// 2. recursively hop finger table
 	// this runs on client node
 	immediate_predecessor, err := node.find_closest_predecessor(id)
+	if err != nil {
+		return nil, err
+	}
 
-	// 3. rpc immediate_predecessor to check break condition
-	// then rpc us back 
+	// 3. immediate_predecessor's immediate successor is id's successor
 	// this runs on client node
-	return FindSuccessor_RPC(immediate_predecessor, node.Id)
+	return GetSuccessorId_RPC(immediate_predecessor)
 
 }
 
@@ -441,15 +653,36 @@ func (node *Node) find_closest_predecessor(id []byte) (*RemoteNode, error) {
 	// maybe random starting node happens to be 
 	hopped_node := node.RemoteSelf // var hopped_node_id int = node.id
 	immediate_succesor, err := GetSuccessorId_RPC(hopped_node)
+	if err != nil {
+		return nil, err
+	}
+	hops := 0
 
 	// TEST: if ANY of hopped node's successor is smaller than new node, hopped node is NOT closest_predecessor
 	// BREAK: if hopped node's immediate(smallest) successor is bigger than new node
 	// == hopped node is closest_predecessor == NONE of hopped node's successor is smaller than new node
-	for !Between(id, hopped_node.Id, immediate_succesor.Id) && !EqualIds(hopped_node.Id, immediate_succesor.Id) {
-		hopped_node, err := ClosestPrecedingFinger_RPC(hopped_node, id)
-		immediate_succesor, err = GetSuccessorId_RPC(hopped_node)
+	for !BetweenRightIncl(id, hopped_node.Id, immediate_succesor.Id) {
+		failed := hopped_node
+		var next_node *RemoteNode
+		next_node, err = ClosestPrecedingFinger_RPC(hopped_node, id)
+		if err == nil && EqualIds(next_node.Id, hopped_node.Id) {
+			// no finger of hopped node gets closer, it is the closest we can find
+			break
+		}
+		if err == nil {
+			failed = next_node
+			immediate_succesor, err = GetSuccessorId_RPC(next_node)
+		}
+		if err != nil {
+			// a dead candidate must not win the next hop on its old RTT
+			node.rtts.forget(failed.Addr)
+			return nil, err
+		}
+		hopped_node = next_node
+		hops++
 	}
-	return hopped_node, err // found new node's closest predecessor
+	lookupHops.observe(float64(hops), HashStr(node.Id))
+	return hopped_node, nil // found new node's closest predecessor
 }
 
 
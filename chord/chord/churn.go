@@ -0,0 +1,111 @@
+/*                                                                           */
+/*  Purpose: Intervals of the stabilize and fix-finger threads, backing off  */
+/*           while the ring is quiet and snapping back on churn.             */
+/*                                                                           */
+
+package chord
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+Wait between rounds of a periodic thread
+
+starts at min, doubles after every round that changed nothing up to max,
+and drops back to min as soon as something changed.
+*/
+type adaptiveInterval struct {
+	lock    sync.Mutex
+	min     time.Duration
+	max     time.Duration
+	current time.Duration
+	wake    chan struct{} /* Cuts a wait short after reset */
+}
+
+/* Shortest wait an adaptiveInterval allows, 0 would spin and never back off */
+const MIN_ADAPTIVE_INTERVAL = time.Millisecond
+
+func newAdaptiveInterval(min time.Duration, max time.Duration) *adaptiveInterval {
+	if min < MIN_ADAPTIVE_INTERVAL {
+		min = MIN_ADAPTIVE_INTERVAL
+	}
+	if max < min {
+		max = min
+	}
+	return &adaptiveInterval{min: min, max: max, current: min, wake: make(chan struct{}, 1)}
+}
+
+/* Sleep until the next round is due, or until reset */
+func (interval *adaptiveInterval) wait() {
+	timer := time.NewTimer(interval.get())
+	select {
+	case <-timer.C:
+	case <-interval.wake:
+		timer.Stop()
+	}
+}
+
+/* Set the wait before the next round, given whether the last one changed anything */
+func (interval *adaptiveInterval) next(changed bool) {
+	interval.lock.Lock()
+	defer interval.lock.Unlock()
+	if changed {
+		interval.current = interval.min
+		return
+	}
+	interval.current *= 2
+	if interval.current > interval.max {
+		interval.current = interval.max
+	}
+}
+
+/* Run the next round now, for changes noticed outside the thread */
+func (interval *adaptiveInterval) reset() {
+	interval.lock.Lock()
+	interval.current = interval.min
+	interval.lock.Unlock()
+	select {
+	case interval.wake <- struct{}{}:
+	default:
+	}
+}
+
+/* Wait before the next round, as it stands */
+func (interval *adaptiveInterval) get() time.Duration {
+	interval.lock.Lock()
+	defer interval.lock.Unlock()
+	return interval.current
+}
+
+/*
+Our neighbours changed, by stabilize or by a notify
+
+fingers are built from the successor, so both threads speed up.
+*/
+func (node *Node) noteChurn() {
+	node.stabilizeInterval.reset()
+	node.fingerInterval.reset()
+}
+
+/* IDs of our successor and predecessor, to tell rounds apart */
+func (node *Node) neighbours() (succ []byte, pred []byte) {
+	node.ftLock.RLock()
+	defer node.ftLock.RUnlock()
+	if node.Successor != nil {
+		succ = node.Successor.Id
+	}
+	if node.Predecessor != nil {
+		pred = node.Predecessor.Id
+	}
+	return succ, pred
+}
+
+/* Same node, or both nil? */
+func sameNode(a *RemoteNode, b *RemoteNode) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return EqualIds(a.Id, b.Id)
+}
@@ -0,0 +1,46 @@
+package chord
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveInterval(t *testing.T) {
+	interval := newAdaptiveInterval(10*time.Millisecond, 50*time.Millisecond)
+	for _, want := range []time.Duration{20, 40, 50, 50} {
+		interval.next(false)
+		if got := interval.get(); got != want*time.Millisecond {
+			t.Errorf("backed off to %v, want %v", got, want*time.Millisecond)
+		}
+	}
+	interval.next(true)
+	if got := interval.get(); got != 10*time.Millisecond {
+		t.Errorf("after a change waiting %v, want the minimum", got)
+	}
+
+	interval.next(false)
+	interval.reset()
+	start := time.Now()
+	interval.wait()
+	if waited := time.Since(start); waited > 5*time.Millisecond {
+		t.Errorf("wait after reset took %v", waited)
+	}
+}
+
+func TestAdaptiveIntervalClampsMin(t *testing.T) {
+	for _, min := range []time.Duration{0, -time.Second} {
+		interval := newAdaptiveInterval(min, 0)
+		if got := interval.get(); got != MIN_ADAPTIVE_INTERVAL {
+			t.Errorf("min %v starts at %v, want %v", min, got, MIN_ADAPTIVE_INTERVAL)
+		}
+		interval.next(false)
+		if got := interval.get(); got != MIN_ADAPTIVE_INTERVAL {
+			t.Errorf("min %v, max 0 backed off to %v", min, got)
+		}
+	}
+	interval := newAdaptiveInterval(0, 4*time.Millisecond)
+	interval.next(false)
+	if got := interval.get(); got != 2*MIN_ADAPTIVE_INTERVAL {
+		t.Errorf("min 0 backed off to %v, want %v", got, 2*MIN_ADAPTIVE_INTERVAL)
+	}
+}
@@ -0,0 +1,275 @@
+/*                                                                           */
+/*  Purpose: Thin client of a Chord ring. Reads and writes keys through RPCs */
+/*           without joining the ring itself.                                */
+/*                                                                           */
+
+package chord
+
+import (
+	"errors"
+	"math/big"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Client of a Chord ring that does not join it
+
+unlike Get/Put, no local Node is needed: no listener, no keys taken over, no
+stabilization. Lookups start at the bootstrap node, and every node learned
+along the way is remembered so later lookups can start from the known node
+closest before the key and skip most of the finger table hops.
+
+the key range (pred, owner] of every owner found is cached too, so a key
+falling in a cached range goes straight to its owner: one RPC instead of a
+lookup plus a call. An owner that rejects the request as not meant for it,
+or that cannot be reached, drops its range; the request follows the owner's
+redirect hint if it gave one, or is retried after a full lookup.
+
+safe for use by multiple goroutines.
+*/
+type Client struct {
+	bootstrap *RemoteNode
+	lock      sync.RWMutex
+	known     []*RemoteNode         /* Ring members seen so far, sorted by ID */
+	routes    map[string]routeEntry /* Owner ID -> key range it owns */
+}
+
+/* Owner is responsible for every id in (Start, Owner.Id] */
+type routeEntry struct {
+	Start []byte
+	Owner *RemoteNode
+}
+
+/* New client entering the ring through bootstrap */
+func NewClient(bootstrap *RemoteNode) *Client {
+	client := new(Client)
+	client.bootstrap = bootstrap
+	client.routes = make(map[string]routeEntry)
+	client.learn(bootstrap)
+	return client
+}
+
+/* Find the node responsible for key, from the routing cache when possible */
+func (client *Client) Lookup(key string) (*RemoteNode, error) {
+	id := HashKey(key)
+	if owner := client.cachedOwner(id); owner != nil {
+		return owner, nil
+	}
+	return client.lookupId(id)
+}
+
+/* Get a value from the ring */
+func (client *Client) Get(key string) (string, error) {
+	var value string
+	err := client.route(key, func(owner *RemoteNode) error {
+		var err error
+		value, err = Get_RPC(owner, key)
+		return err
+	})
+	return value, err
+}
+
+/* Put a key/value into the ring */
+func (client *Client) Put(key string, value string) error {
+	return client.PutWithTTL(key, value, 0)
+}
+
+/* Put a key/value that expires after ttl into the ring, 0 never expires */
+func (client *Client) PutWithTTL(key string, value string, ttl time.Duration) error {
+	if ttl < 0 {
+		return errors.New("TTL must not be negative")
+	}
+	return client.route(key, func(owner *RemoteNode) error {
+		return PutTTL_RPC(owner, key, value, ttl)
+	})
+}
+
+/* Delete a key from the ring */
+func (client *Client) Delete(key string) error {
+	return client.route(key, func(owner *RemoteNode) error {
+		return Delete_RPC(owner, key)
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+
+/* Redirects followed for a single request before giving up on them */
+const MAX_REDIRECTS = 3
+
+/*
+run call against the owner of key
+
+an owner that refuses the key with a redirect hint is dropped from the
+cache and the hinted node tried instead, up to MAX_REDIRECTS times. An owner
+that is wrong without a hint, or unreachable, makes us fall back to a full
+lookup, once.
+*/
+func (client *Client) route(key string, call func(owner *RemoteNode) error) error {
+	id := HashKey(key)
+	owner := client.cachedOwner(id)
+	fullLookup := owner == nil
+	if fullLookup {
+		var err error
+		if owner, err = client.lookupId(id); err != nil {
+			return err
+		}
+	}
+
+	for redirects := 0; ; {
+		err := call(owner)
+		if !IsWrongNodeError(err) && !isTransportError(err) {
+			return err
+		}
+		client.invalidate(owner)
+
+		if wrong, ok := err.(*WrongOwnerError); ok && wrong.Owner != nil && redirects < MAX_REDIRECTS {
+			redirects++
+			client.learn(wrong.Owner)
+			owner = wrong.Owner
+			continue
+		}
+		if fullLookup {
+			return err
+		}
+		fullLookup = true
+		if owner, err = client.lookupId(id); err != nil {
+			return err
+		}
+	}
+}
+
+/* Errors that did not come back from the remote handler, i.e. dial or connection failures */
+func isTransportError(err error) bool {
+	if err == nil {
+		return false
+	}
+	_, fromHandler := err.(rpc.ServerError)
+	return !fromHandler
+}
+
+/* Owner of a cached range containing id, nil on a miss */
+func (client *Client) cachedOwner(id []byte) *RemoteNode {
+	client.lock.RLock()
+	defer client.lock.RUnlock()
+
+	for _, route := range client.routes {
+		if BetweenRightIncl(id, route.Start, route.Owner.Id) {
+			return route.Owner
+		}
+	}
+	return nil
+}
+
+/*
+cache the range owner is responsible for, i.e. (predecessor, owner]
+
+the predecessor is asked from the owner itself, if it does not know one yet
+nothing is cached.
+*/
+func (client *Client) cacheRange(owner *RemoteNode) {
+	pred, err := GetPredecessorId_RPC(owner)
+	if err != nil || pred == nil {
+		return
+	}
+	client.learn(pred)
+
+	client.lock.Lock()
+	client.routes[string(owner.Id)] = routeEntry{pred.Id, owner}
+	client.lock.Unlock()
+}
+
+/* Forget the cached range of owner */
+func (client *Client) invalidate(owner *RemoteNode) {
+	client.lock.Lock()
+	delete(client.routes, string(owner.Id))
+	client.lock.Unlock()
+}
+
+/*
+successor of id, asked from the closest known node before id
+
+a known node that does not answer is forgotten and the lookup retried from
+the next best one, failing at the bootstrap node is final.
+*/
+func (client *Client) lookupId(id []byte) (*RemoteNode, error) {
+	for {
+		start := client.closestPreceding(id)
+		if start == nil {
+			start = client.bootstrap
+		}
+		owner, err := FindSuccessor_RPC(start, id)
+		if err == nil && owner.Id != nil {
+			client.learn(owner)
+			client.cacheRange(owner)
+			return owner, nil
+		}
+		if start == client.bootstrap {
+			if err == nil {
+				err = errors.New("lookup returned no node")
+			}
+			return nil, err
+		}
+		client.forget(start)
+	}
+}
+
+/* Known node with the shortest clockwise distance to id */
+func (client *Client) closestPreceding(id []byte) *RemoteNode {
+	client.lock.RLock()
+	defer client.lock.RUnlock()
+
+	ring := new(big.Int).Lsh(big.NewInt(1), KEY_LENGTH)
+	target := new(big.Int).SetBytes(id)
+	var best *RemoteNode
+	var bestDist *big.Int
+	for _, n := range client.known {
+		dist := new(big.Int).Sub(target, new(big.Int).SetBytes(n.Id))
+		dist.Mod(dist, ring)
+		if best == nil || dist.Cmp(bestDist) < 0 {
+			best = n
+			bestDist = dist
+		}
+	}
+	return best
+}
+
+/* Remember a ring member */
+func (client *Client) learn(remoteNode *RemoteNode) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	i := sort.Search(len(client.known), func(i int) bool {
+		return new(big.Int).SetBytes(client.known[i].Id).Cmp(new(big.Int).SetBytes(remoteNode.Id)) >= 0
+	})
+	if i < len(client.known) && EqualIds(client.known[i].Id, remoteNode.Id) {
+		if client.known[i].Addr == remoteNode.Addr {
+			return
+		}
+		// same id at a new address, the old one is stale
+		client.known[i] = remoteNode
+		return
+	}
+	client.known = append(client.known, nil)
+	copy(client.known[i+1:], client.known[i:])
+	client.known[i] = remoteNode
+}
+
+/* Drop a ring member that stopped answering */
+func (client *Client) forget(remoteNode *RemoteNode) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	delete(client.routes, string(remoteNode.Id))
+	for i, n := range client.known {
+		if n == remoteNode {
+			client.known = append(client.known[:i], client.known[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package chord
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+/* Node of nodes with the same ID as remoteNode */
+func nodeOf(nodes []*Node, remoteNode *RemoteNode) *Node {
+	for _, node := range nodes {
+		if EqualIds(node.Id, remoteNode.Id) {
+			return node
+		}
+	}
+	return nil
+}
+
+func ringOf(nodes []*Node) []*RemoteNode {
+	remotes := make([]*RemoteNode, len(nodes))
+	for i, node := range nodes {
+		remotes[i] = node.RemoteSelf
+	}
+	return remotes
+}
+
+func TestClientPutGetDelete(t *testing.T) {
+	nodes := newTestRing(t, 10, 70, 130, 200)
+	client := NewClient(nodes[0].RemoteSelf)
+
+	var keys []string
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("k%v", i))
+	}
+	for _, k := range keys {
+		if err := client.Put(k, "v-"+k); err != nil {
+			t.Fatalf("put %v: %v", k, err)
+		}
+	}
+	for _, k := range keys {
+		owner := nodeOf(nodes, ownerOf(HashKey(k), ringOf(nodes)))
+		for _, node := range nodes {
+			_, ok := node.dataStore[k]
+			if ok != (node == owner) {
+				t.Errorf("key %v (hash %v) held by %v: %v, owner is %v", k, HashStr(HashKey(k)), HashStr(node.Id), ok, HashStr(owner.Id))
+			}
+		}
+		if value, err := client.Get(k); err != nil || value != "v-"+k {
+			t.Errorf("get %v = %q, %v", k, value, err)
+		}
+	}
+
+	if err := client.Delete(keys[0]); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := client.Get(keys[0]); err == nil {
+		t.Errorf("deleted key still readable")
+	}
+	if value, err := client.Get(keys[1]); err != nil || value != "v-"+keys[1] {
+		t.Errorf("delete of %v took %v with it: %q, %v", keys[0], keys[1], value, err)
+	}
+}
+
+func TestClientLookup(t *testing.T) {
+	nodes := newTestRing(t, 10, 70, 130, 200)
+	client := NewClient(nodes[2].RemoteSelf)
+
+	for i := 0; i < 20; i++ {
+		k := fmt.Sprintf("k%v", i)
+		owner, err := client.Lookup(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := ownerOf(HashKey(k), ringOf(nodes)); !EqualIds(owner.Id, want.Id) || owner.Addr != want.Addr {
+			t.Errorf("lookup of %v (hash %v) = %v, want %v", k, HashStr(HashKey(k)), HashStr(owner.Id), HashStr(want.Id))
+		}
+	}
+	// every owner found was learned along the way
+	if len(client.known) != len(nodes) {
+		t.Errorf("client knows %v nodes after looking up every range, want %v", len(client.known), len(nodes))
+	}
+}
+
+func TestClientNegativeTTL(t *testing.T) {
+	nodes := newTestRing(t, 10, 200)
+	client := NewClient(nodes[0].RemoteSelf)
+	if err := client.PutWithTTL("k", "v", -time.Second); err == nil {
+		t.Errorf("negative TTL accepted")
+	}
+	for _, node := range nodes {
+		if len(node.dataStore) != 0 {
+			t.Errorf("rejected put stored %v keys on %v", len(node.dataStore), HashStr(node.Id))
+		}
+	}
+}
+
+func TestClientUnreachableBootstrap(t *testing.T) {
+	node := newTestRing(t, 10)[0]
+	node.Listener.Close()
+	client := NewClient(&RemoteNode{node.Id, node.Addr})
+	if _, err := client.Get("k"); err == nil {
+		t.Errorf("get through a closed bootstrap node succeeded")
+	}
+	if err := client.Put("k", "v"); err == nil {
+		t.Errorf("put through a closed bootstrap node succeeded")
+	}
+}
+
+/* RPCs handled so far by nodes, successful or not, not counting connection handshakes */
+func handledRpcs(nodes ...*Node) int {
+	rpcHandledTotal.lock.Lock()
+	defer rpcHandledTotal.lock.Unlock()
+	total := 0.0
+	for _, s := range rpcHandledTotal.series {
+		for _, node := range nodes {
+			if s.values[0] == HashStr(node.Id) && s.values[1] != "Hello_Handler" {
+				total += s.value
+			}
+		}
+	}
+	return int(total)
+}
+
+/* First of keys k0, k1, ... other than skip whose hash is in (from, to] */
+func keyIn(t *testing.T, from, to byte, skip string) string {
+	for i := 0; i < 10000; i++ {
+		k := fmt.Sprintf("k%v", i)
+		if k != skip && BetweenRightIncl(HashKey(k), []byte{from}, []byte{to}) {
+			return k
+		}
+	}
+	t.Fatalf("no key in (%v, %v]", from, to)
+	return ""
+}
+
+func TestClientCachedRangeCostsOneRpc(t *testing.T) {
+	nodes := newTestRing(t, 10, 70, 130, 200)
+	first := keyIn(t, 70, 130, "")
+	second := keyIn(t, 70, 130, first)
+	putOnOwners(nodes, first, second)
+	client := NewClient(nodes[0].RemoteSelf)
+
+	before := handledRpcs(nodes...)
+	if _, err := client.Get(first); err != nil {
+		t.Fatal(err)
+	}
+	if cost := handledRpcs(nodes...) - before; cost < 2 {
+		t.Errorf("uncached get took %v RPCs, expected a lookup first", cost)
+	}
+
+	before = handledRpcs(nodes...)
+	if value, err := client.Get(second); err != nil || value != "v-"+second {
+		t.Fatalf("get %v = %q, %v", second, value, err)
+	}
+	if cost := handledRpcs(nodes...) - before; cost != 1 {
+		t.Errorf("get in a cached range took %v RPCs, want 1", cost)
+	}
+}
+
+/*
+ring of 10, 130, 200 whose client has cached (10, 130] for 130, then 70 joins
+and takes (10, 70] over, with the key of the returned name moved onto it
+*/
+func staleRange(t *testing.T) ([]*Node, *Node, *Client, string) {
+	nodes := newTestRing(t, 10, 130, 200)
+	owner := nodes[1]
+	key := keyIn(t, 10, 70, "")
+	putOnOwners(nodes, key)
+	client := NewClient(nodes[0].RemoteSelf)
+	if _, err := client.Get(key); err != nil {
+		t.Fatal(err)
+	}
+	if cached := client.cachedOwner(HashKey(key)); cached == nil || !EqualIds(cached.Id, owner.Id) {
+		t.Fatalf("range of %v not cached", HashStr(owner.Id))
+	}
+
+	joined := newTestNode(t, []byte{70})
+	joined.Predecessor = nodes[0].RemoteSelf
+	joined.Successor = owner.RemoteSelf
+	owner.ftLock.Lock()
+	owner.Predecessor = joined.RemoteSelf
+	owner.ftLock.Unlock()
+	joined.dataStore[key] = owner.dataStore[key]
+	delete(owner.dataStore, key)
+	return nodes, joined, client, key
+}
+
+func TestClientInvalidatesStaleRange(t *testing.T) {
+	_, joined, client, key := staleRange(t)
+	owner := client.cachedOwner(HashKey(key))
+
+	if _, err := client.Get(key); err != nil {
+		t.Fatal(err)
+	}
+	if route, ok := client.routes[string(owner.Id)]; ok && !EqualIds(route.Start, joined.Id) {
+		t.Errorf("range (%v, %v] still cached after %v refused a key in it",
+			HashStr(route.Start), HashStr(owner.Id), HashStr(owner.Id))
+	}
+	if cached := client.cachedOwner(HashKey(key)); cached != nil && EqualIds(cached.Id, owner.Id) {
+		t.Errorf("key %v still routed to %v", key, HashStr(owner.Id))
+	}
+}
+
+func TestClientFollowsRedirect(t *testing.T) {
+	nodes, joined, client, key := staleRange(t)
+
+	before := handledRpcs(append(nodes, joined)...)
+	value, err := client.Get(key)
+	if err != nil || value != "v-"+key {
+		t.Fatalf("get %v = %q, %v", key, value, err)
+	}
+	// the refusal and the redirected get, no lookup in between
+	if cost := handledRpcs(append(nodes, joined)...) - before; cost != 2 {
+		t.Errorf("redirected get took %v RPCs, want 2", cost)
+	}
+	if err := client.Put(key, "new"); err != nil {
+		t.Fatal(err)
+	}
+	if joined.dataStore[key].Value != "new" {
+		t.Errorf("put did not reach the new owner %v", HashStr(joined.Id))
+	}
+}
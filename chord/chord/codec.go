@@ -0,0 +1,437 @@
+/*                                                                           */
+/*  Purpose: Wire codecs used by the RPC server and client: gob, JSON-RPC    */
+/*           and length-prefixed binary frames, picked per connection.       */
+/*           net/rpc keeps its gob codecs private, so we carry our own.      */
+/*                                                                           */
+
+package chord
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"strings"
+	"sync"
+)
+
+/*
+Encoding of RPCs on a connection
+
+the server tells them apart by the first bytes the client sends, so every
+node understands all of them and only clients choose.
+
+	CODEC_GOB     net/rpc's gob stream, what Go nodes talk among themselves
+	CODEC_JSON    JSON-RPC 1.0 as in net/rpc/jsonrpc, one object per call:
+	              {"method": "<node addr>.Get_Handler", "params": [{...}], "id": 1}
+	CODEC_BINARY  BINARY_MAGIC, then one frame per call, see writeFrame
+*/
+type WireCodec int
+
+const (
+	CODEC_GOB WireCodec = iota
+	CODEC_JSON
+	CODEC_BINARY
+)
+
+/* Sent once by binary clients before their first frame */
+const BINARY_MAGIC = "CHB1"
+
+/*
+Frames longer than this are refused. A whole node's keys fit in one
+GetRange reply, hence the size; readFrame only allocates as bytes arrive
+*/
+const BINARY_MAX_FRAME = 64 << 20
+
+func (codec WireCodec) String() string {
+	switch codec {
+	case CODEC_GOB:
+		return "gob"
+	case CODEC_JSON:
+		return "json"
+	case CODEC_BINARY:
+		return "binary"
+	}
+	return fmt.Sprintf("WireCodec(%d)", int(codec))
+}
+
+/* "gob", "json" or "binary" */
+func ParseWireCodec(s string) (WireCodec, error) {
+	switch strings.ToLower(s) {
+	case "gob":
+		return CODEC_GOB, nil
+	case "json":
+		return CODEC_JSON, nil
+	case "binary":
+		return CODEC_BINARY, nil
+	}
+	return 0, errors.New(fmt.Sprintf("unknown codec %q, expected gob, json or binary", s))
+}
+
+/* Encoding of a value carried inside another message, as signed payloads are */
+func (codec WireCodec) marshal(v interface{}) ([]byte, error) {
+	if codec == CODEC_GOB {
+		var buf bytes.Buffer
+		err := gob.NewEncoder(&buf).Encode(v)
+		return buf.Bytes(), err
+	}
+	return json.Marshal(v)
+}
+
+func (codec WireCodec) unmarshal(data []byte, v interface{}) error {
+	if codec == CODEC_GOB {
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (codec WireCodec) newClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	switch codec {
+	case CODEC_JSON:
+		return jsonrpc.NewClientCodec(conn)
+	case CODEC_BINARY:
+		return newBinaryClientCodec(conn)
+	}
+	return newGobClientCodec(conn)
+}
+
+/* Codec outgoing connections of this process use */
+var clientCodec WireCodec
+var clientCodecLock sync.RWMutex
+
+/*
+Talk codec on connections this process opens from now on
+
+nodes keep talking to each other in gob unless told otherwise, this is for
+Clients and tools that want to see the JSON or binary protocol used.
+Connections already open keep their codec.
+*/
+func UseWireCodec(codec WireCodec) {
+	clientCodecLock.Lock()
+	clientCodec = codec
+	clientCodecLock.Unlock()
+}
+
+/* A connection whose first bytes were looked at, reads still see them */
+type sniffedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *sniffedConn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
+
+/*
+Work out the codec of a new server connection from its first bytes
+
+JSON starts with '{' or whitespace, binary with BINARY_MAGIC (which is
+consumed), anything else is taken for gob, whose streams start with a
+message length well below those bytes.
+*/
+func sniffCodec(conn net.Conn) (WireCodec, net.Conn, error) {
+	sniffed := &sniffedConn{conn, bufio.NewReader(conn)}
+	first, err := sniffed.reader.Peek(1)
+	if err != nil {
+		return 0, nil, err
+	}
+	switch first[0] {
+	case '{', ' ', '\t', '\r', '\n':
+		return CODEC_JSON, sniffed, nil
+	case BINARY_MAGIC[0]:
+		magic, err := sniffed.reader.Peek(len(BINARY_MAGIC))
+		if err != nil {
+			return 0, nil, err
+		}
+		if string(magic) != BINARY_MAGIC {
+			return 0, nil, errors.New(fmt.Sprintf("unknown protocol, starts with %q", magic))
+		}
+		sniffed.reader.Discard(len(BINARY_MAGIC))
+		return CODEC_BINARY, sniffed, nil
+	}
+	return CODEC_GOB, sniffed, nil
+}
+
+func newServerCodec(codec WireCodec, conn io.ReadWriteCloser) rpc.ServerCodec {
+	switch codec {
+	case CODEC_JSON:
+		return jsonrpc.NewServerCodec(conn)
+	case CODEC_BINARY:
+		return newBinaryServerCodec(conn)
+	}
+	return newGobServerCodec(conn)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+
+/* Same wire format as the codec behind rpc.ServeConn */
+type gobServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+}
+
+func newGobServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobServerCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+	}
+}
+
+func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobServerCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Gob couldn't encode the header. Should not happen, so if it does,
+			// shut down the connection to signal that the connection is broken.
+			c.Close()
+		}
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Was a gob problem encoding the body but the header has been written.
+			// Shut down the connection to signal that the connection is broken.
+			c.Close()
+		}
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobServerCodec) Close() error {
+	if c.closed {
+		// Only call c.rwc.Close once; otherwise the semantics are undefined.
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
+
+/* Same wire format as the codec behind rpc.NewClient */
+type gobClientCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+}
+
+func newGobClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobClientCodec{conn, gob.NewDecoder(conn), gob.NewEncoder(buf), buf}
+}
+
+func (c *gobClientCodec) WriteRequest(r *rpc.Request, body interface{}) (err error) {
+	if err = c.enc.Encode(r); err != nil {
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobClientCodec) ReadResponseBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobClientCodec) Close() error {
+	return c.rwc.Close()
+}
+
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+
+/* One call or reply of the binary protocol */
+type frame struct {
+	seq    uint64
+	method string /* Service method, "<node addr>.<handler>" */
+	error  string /* Set on replies that failed, body is then {} */
+	body   []byte /* JSON */
+}
+
+/*
+Write f as one binary frame, all integers big-endian
+
+	uint32  length of everything after it
+	uint64  sequence number, a reply carries its call's
+	uint16  length of the method, then the method
+	uint32  length of the error, then the error
+	        the body as JSON, up to the end of the frame
+*/
+func writeFrame(w *bufio.Writer, f *frame) error {
+	var head [4 + 8 + 2]byte
+	size := 8 + 2 + len(f.method) + 4 + len(f.error) + len(f.body)
+	if size > BINARY_MAX_FRAME || len(f.method) > 0xffff {
+		return errors.New(fmt.Sprintf("frame of %v bytes too large", size))
+	}
+	binary.BigEndian.PutUint32(head[0:], uint32(size))
+	binary.BigEndian.PutUint64(head[4:], f.seq)
+	binary.BigEndian.PutUint16(head[12:], uint16(len(f.method)))
+	w.Write(head[:])
+	w.WriteString(f.method)
+	var errLen [4]byte
+	binary.BigEndian.PutUint32(errLen[:], uint32(len(f.error)))
+	w.Write(errLen[:])
+	w.WriteString(f.error)
+	w.Write(f.body)
+	return w.Flush()
+}
+
+func readFrame(r io.Reader) (*frame, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > BINARY_MAX_FRAME {
+		return nil, errors.New(fmt.Sprintf("frame of %v bytes too large", n))
+	}
+	// grown as the bytes arrive, not from the length the peer claims: on a
+	// connection nobody authenticated yet, 4 bytes must not cost 64MB
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	data := buf.Bytes()
+
+	// every length is checked against what is left before it is used
+	truncated := errors.New("truncated frame")
+	if len(data) < 8+2 {
+		return nil, truncated
+	}
+	f := &frame{seq: binary.BigEndian.Uint64(data)}
+	methodLen := int(binary.BigEndian.Uint16(data[8:]))
+	data = data[10:]
+	if len(data) < methodLen+4 {
+		return nil, truncated
+	}
+	f.method = string(data[:methodLen])
+	data = data[methodLen:]
+	errLen := int(binary.BigEndian.Uint32(data))
+	data = data[4:]
+	if len(data) < errLen {
+		return nil, truncated
+	}
+	f.error = string(data[:errLen])
+	f.body = data[errLen:]
+	return f, nil
+}
+
+type binaryServerCodec struct {
+	rwc  io.ReadWriteCloser
+	buf  *bufio.Writer
+	body []byte /* Of the request whose header was read last */
+}
+
+func newBinaryServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return &binaryServerCodec{rwc: conn, buf: bufio.NewWriter(conn)}
+}
+
+func (c *binaryServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	f, err := readFrame(c.rwc)
+	if err != nil {
+		return err
+	}
+	r.Seq = f.seq
+	r.ServiceMethod = f.method
+	c.body = f.body
+	return nil
+}
+
+func (c *binaryServerCodec) ReadRequestBody(body interface{}) error {
+	if body == nil {
+		return nil
+	}
+	return json.Unmarshal(c.body, body)
+}
+
+func (c *binaryServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return writeFrame(c.buf, &frame{r.Seq, r.ServiceMethod, r.Error, data})
+}
+
+func (c *binaryServerCodec) Close() error {
+	return c.rwc.Close()
+}
+
+type binaryClientCodec struct {
+	rwc     io.ReadWriteCloser
+	buf     *bufio.Writer
+	body    []byte /* Of the response whose header was read last */
+	greeted bool   /* BINARY_MAGIC was sent */
+}
+
+func newBinaryClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return &binaryClientCodec{rwc: conn, buf: bufio.NewWriter(conn)}
+}
+
+func (c *binaryClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	// net/rpc never writes two requests at once
+	if !c.greeted {
+		c.buf.WriteString(BINARY_MAGIC)
+		c.greeted = true
+	}
+	return writeFrame(c.buf, &frame{r.Seq, r.ServiceMethod, "", data})
+}
+
+func (c *binaryClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	f, err := readFrame(c.rwc)
+	if err != nil {
+		return err
+	}
+	r.Seq = f.seq
+	r.ServiceMethod = f.method
+	r.Error = f.error
+	c.body = f.body
+	return nil
+}
+
+func (c *binaryClientCodec) ReadResponseBody(body interface{}) error {
+	if body == nil {
+		return nil
+	}
+	return json.Unmarshal(c.body, body)
+}
+
+func (c *binaryClientCodec) Close() error {
+	return c.rwc.Close()
+}
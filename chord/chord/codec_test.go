@@ -0,0 +1,78 @@
+package chord
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	sent := &frame{7, "localhost:7000.Get_Handler", "oops", []byte(`{"Key":"a"}`)}
+	if err := writeFrame(bufio.NewWriter(&buf), sent); err != nil {
+		t.Fatal(err)
+	}
+	wire := buf.Bytes()
+	got, err := readFrame(bytes.NewReader(wire))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.seq != sent.seq || got.method != sent.method || got.error != sent.error || !bytes.Equal(got.body, sent.body) {
+		t.Errorf("read back %+v, sent %+v", got, sent)
+	}
+
+	// a length that claims more than the frame holds
+	wire[13] = 0xff
+	if _, err := readFrame(bytes.NewReader(wire)); err == nil {
+		t.Errorf("truncated frame accepted")
+	}
+}
+
+func TestReadFrameAllocatesWhatArrives(t *testing.T) {
+	// a header claiming the largest frame, followed by a few bytes and the end
+	wire := make([]byte, 4+16)
+	binary.BigEndian.PutUint32(wire, BINARY_MAX_FRAME)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := readFrame(bytes.NewReader(wire))
+	runtime.ReadMemStats(&after)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("short frame read with %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("%v bytes allocated for a frame of 16", allocated)
+	}
+}
+
+func TestSniffCodec(t *testing.T) {
+	for _, tc := range []struct {
+		first string
+		want  WireCodec
+	}{
+		{`{"method": "x"}`, CODEC_JSON},
+		{BINARY_MAGIC + "\x00\x00", CODEC_BINARY},
+		{"\x2a\xff\x81", CODEC_GOB},
+	} {
+		server, client := net.Pipe()
+		go client.Write([]byte(tc.first))
+		got, conn, err := sniffCodec(server)
+		if err != nil || got != tc.want {
+			t.Errorf("%q sniffed as %v (%v), want %v", tc.first, got, err, tc.want)
+		}
+		// the magic is consumed, everything else is left for the codec
+		rest := make([]byte, 2)
+		if got == CODEC_BINARY {
+			conn.Read(rest)
+			if string(rest) != "\x00\x00" {
+				t.Errorf("binary magic not consumed, read %q", rest)
+			}
+		}
+		server.Close()
+		client.Close()
+	}
+}
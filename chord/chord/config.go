@@ -0,0 +1,48 @@
+/*                                                                           */
+/*  Purpose: Per-node configuration, passed to CreateNodeWithConfig.         */
+/*                                                                           */
+
+package chord
+
+import (
+	"os"
+	"time"
+)
+
+/* Settings of a single Chord node */
+type Config struct {
+	Logger                Logger        /* Where the node logs to, tagged with its ID and address */
+	ExpirySweepInterval   time.Duration /* How often keys past their TTL are removed */
+	Replicas              int           /* Copies of every key, the owner's included. 1 turns replication off */
+	AntiEntropyInterval   time.Duration /* How often replicas are compared and repaired */
+	TLS                   *TLSConfig    /* Mutual TLS for the RPC listener and outgoing calls, nil for plain TCP */
+	ClusterSecret         []byte        /* Key every request must be signed with, nil accepts unsigned requests */
+	IdScheme              IdScheme      /* How our ID and our peers' IDs must be derived */
+	MaxConns              int           /* Incoming connections served at once, requests on more are refused. 0 for no limit */
+	MaxInFlight           int           /* Requests handled at once, more are refused as overloaded. 0 for no limit */
+	MaxInFlightPerPeer    int           /* Same per remote host */
+	RequestRate           float64       /* Requests per second accepted, bursts of up to a second's worth. 0 for no limit */
+	RequestRatePerPeer    float64       /* Same per remote host */
+	StabilizeMinInterval  time.Duration /* Wait between stabilize rounds right after a change */
+	StabilizeMaxInterval  time.Duration /* Longest wait, reached by doubling while nothing changes */
+	FixFingersMinInterval time.Duration /* Same between refreshing one finger and the next */
+	FixFingersMaxInterval time.Duration
+	FingerCandidates      int /* Nodes kept per finger, lookups hop to the lowest RTT one. 1 keeps only the successor of the start */
+}
+
+/* Configuration used by CreateNode and CreateDefinedNode */
+func DefaultConfig() *Config {
+	config := new(Config)
+	config.Logger = NewLogger(os.Stderr, LevelInfo)
+	config.ExpirySweepInterval = time.Second
+	config.Replicas = 1
+	config.AntiEntropyInterval = 10 * time.Second
+	config.MaxConns = 1024
+	config.MaxInFlight = 512
+	config.StabilizeMinInterval = 50 * time.Millisecond
+	config.StabilizeMaxInterval = 2 * time.Second
+	config.FixFingersMinInterval = 50 * time.Millisecond
+	config.FixFingersMaxInterval = 5 * time.Second
+	config.FingerCandidates = 1
+	return config
+}
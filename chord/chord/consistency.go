@@ -0,0 +1,281 @@
+/*                                                                           */
+/*  Purpose: Reads and writes that wait for one, a quorum or all replicas of */
+/*           a key, newest version wins and stale replicas are repaired.     */
+/*                                                                           */
+
+package chord
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/* How many replicas of a key must answer a GetWithConsistency/PutWithConsistency/DeleteWithConsistency */
+type Consistency int
+
+const (
+	CONSISTENCY_ONE    Consistency = iota /* The owner alone for writes, any replica for reads */
+	CONSISTENCY_QUORUM                    /* A majority of the replicas */
+	CONSISTENCY_ALL                       /* Every replica */
+)
+
+func (level Consistency) String() string {
+	switch level {
+	case CONSISTENCY_ONE:
+		return "one"
+	case CONSISTENCY_QUORUM:
+		return "quorum"
+	case CONSISTENCY_ALL:
+		return "all"
+	}
+	return fmt.Sprintf("Consistency(%d)", int(level))
+}
+
+/* "one", "quorum" or "all" */
+func ParseConsistency(s string) (Consistency, error) {
+	switch strings.ToLower(s) {
+	case "one":
+		return CONSISTENCY_ONE, nil
+	case "quorum":
+		return CONSISTENCY_QUORUM, nil
+	case "all":
+		return CONSISTENCY_ALL, nil
+	}
+	return 0, errors.New(fmt.Sprintf("unknown consistency level %q, expected one, quorum or all", s))
+}
+
+/* Answers needed out of n replicas */
+func (level Consistency) required(n int) int {
+	switch level {
+	case CONSISTENCY_QUORUM:
+		return n/2 + 1
+	case CONSISTENCY_ALL:
+		return n
+	}
+	return 1
+}
+
+/*
+Get a value from the replicas of key, waiting for as many as level asks for
+
+the newest version among the answers wins. Once every replica answered, the
+ones that returned an older version or nothing are sent the winner in the
+background (read repair).
+*/
+func (client *Client) GetWithConsistency(key string, level Consistency) (string, error) {
+	var value string
+	err := client.route(key, func(owner *RemoteNode) error {
+		replicas, wanted, err := ReplicaSet_RPC(owner, key)
+		if err != nil {
+			return err
+		}
+		value, err = readReplicas(key, replicas, wanted, level)
+		return err
+	})
+	return value, err
+}
+
+/*
+Put a key/value into the replicas of key, waiting for as many as level asks for
+
+the write is stamped with the current time as its version. The owner is
+always among the replicas that must acknowledge, which lets anti-entropy
+treat the owner's copy as the reference. Replicas that did not answer in
+time still get the write in the background.
+*/
+func (client *Client) PutWithConsistency(key string, value string, ttl time.Duration, level Consistency) error {
+	if ttl < 0 {
+		return errors.New("TTL must not be negative")
+	}
+	return client.route(key, func(owner *RemoteNode) error {
+		replicas, wanted, err := ReplicaSet_RPC(owner, key)
+		if err != nil {
+			return err
+		}
+		version := time.Now().UnixNano()
+		return writeReplicas(replicas, wanted, level, func(r *RemoteNode) error {
+			return PutVersioned_RPC(r, key, value, ttl, version)
+		})
+	})
+}
+
+/*
+Delete key from its replicas, waiting for as many as level asks for
+
+like PutWithConsistency, but what is written is a tombstone stamped with
+the current time. Replicas keep it for TOMBSTONE_TTL, so a read or repair
+meanwhile sees the delete win over older copies instead of bringing them
+back.
+*/
+func (client *Client) DeleteWithConsistency(key string, level Consistency) error {
+	return client.route(key, func(owner *RemoteNode) error {
+		replicas, wanted, err := ReplicaSet_RPC(owner, key)
+		if err != nil {
+			return err
+		}
+		version := time.Now().UnixNano()
+		return writeReplicas(replicas, wanted, level, func(r *RemoteNode) error {
+			return DeleteVersioned_RPC(r, key, version)
+		})
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+
+/* Answer of one replica */
+type replicaReply struct {
+	replica *RemoteNode
+	reply   *KeyValueReply
+	err     error
+}
+
+/* Call every replica in parallel, answers arrive on the returned channel */
+func callReplicas(replicas []*RemoteNode, call func(replica *RemoteNode) (*KeyValueReply, error)) <-chan replicaReply {
+	replies := make(chan replicaReply, len(replicas))
+	for _, r := range replicas {
+		go func(r *RemoteNode) {
+			reply, err := call(r)
+			replies <- replicaReply{r, reply, err}
+		}(r)
+	}
+	return replies
+}
+
+/*
+replicas[0] is the owner, wanted the number of replicas key should have
+
+level counts against wanted, not against the replicas found: with some of
+them unreachable a quorum of the rest is no quorum.
+*/
+func readReplicas(key string, replicas []*RemoteNode, wanted int, level Consistency) (string, error) {
+	required := level.required(wanted)
+	if len(replicas) < required {
+		return "", errors.New(fmt.Sprintf("read at %v failed, %v of %v replicas reachable", level, len(replicas), wanted))
+	}
+	replies := callReplicas(replicas, func(r *RemoteNode) (*KeyValueReply, error) {
+		return GetVersioned_RPC(r, key)
+	})
+
+	var answers []replicaReply
+	var best *KeyValueReply
+	var lastErr error
+	for i := 0; i < len(replicas) && len(answers) < required; i++ {
+		res := <-replies
+		if res.err != nil {
+			lastErr = res.err
+			continue
+		}
+		answers = append(answers, res)
+		if best == nil || res.reply.Version > best.Version {
+			best = res.reply
+		}
+	}
+	if len(answers) < required {
+		return "", errors.New(fmt.Sprintf("read at %v failed, %v of %v replicas answered: %v",
+			level, len(answers), wanted, lastErr))
+	}
+
+	go readRepair(key, best, answers, replies, len(replicas)-len(answers))
+	if best.Version == 0 || best.Deleted {
+		return "", errors.New(fmt.Sprintf("Key %v not found", key))
+	}
+	return best.Value, nil
+}
+
+/* Wait for the outstanding answers and send the newest version to every stale replica */
+func readRepair(key string, best *KeyValueReply, answers []replicaReply, replies <-chan replicaReply, outstanding int) {
+	for i := 0; i < outstanding; i++ {
+		if res := <-replies; res.err == nil {
+			answers = append(answers, res)
+			if res.reply.Version > best.Version {
+				best = res.reply
+			}
+		}
+	}
+	if best.Version == 0 {
+		return
+	}
+	for _, res := range answers {
+		if res.reply.Version >= best.Version {
+			continue
+		}
+		if best.Deleted {
+			DeleteVersioned_RPC(res.replica, key, best.Version)
+		} else {
+			PutVersioned_RPC(res.replica, key, best.Value, best.TTL, best.Version)
+		}
+	}
+}
+
+/*
+Run write on replicas, replicas[0] is the owner, its acknowledgement is always required
+
+like readReplicas, level counts against wanted. A write that cannot get
+enough acknowledgements from the replicas found is not sent at all.
+*/
+func writeReplicas(replicas []*RemoteNode, wanted int, level Consistency, write func(r *RemoteNode) error) error {
+	required := level.required(wanted)
+	if len(replicas) < required {
+		return errors.New(fmt.Sprintf("write at %v failed, %v of %v replicas reachable", level, len(replicas), wanted))
+	}
+	replies := callReplicas(replicas, func(r *RemoteNode) (*KeyValueReply, error) {
+		return nil, write(r)
+	})
+
+	acks := 0
+	ownerAcked := false
+	var lastErr error
+	for i := 0; i < len(replicas) && (acks < required || !ownerAcked); i++ {
+		res := <-replies
+		if res.err != nil {
+			if res.replica == replicas[0] {
+				// owner errors go back to route, which retries on a wrong or dead owner
+				return res.err
+			}
+			lastErr = res.err
+			continue
+		}
+		acks++
+		if res.replica == replicas[0] {
+			ownerAcked = true
+		}
+	}
+	if acks < required || !ownerAcked {
+		return errors.New(fmt.Sprintf("write at %v failed, %v of %v replicas acknowledged: %v",
+			level, acks, wanted, lastErr))
+	}
+	return nil
+}
+
+/*
+owner followed by its next Replicas-1 successors, and how many replicas
+there should be: Replicas, or the ring size when the walk comes back around
+to us first. A successor that cannot be reached ends the list early without
+lowering wanted, the ring is not known to be any smaller.
+*/
+func (node *Node) replicaSet() (replicas []*RemoteNode, wanted int) {
+	replicas = []*RemoteNode{node.RemoteSelf}
+	seen := map[string]bool{string(node.Id): true}
+	node.ftLock.RLock()
+	succ := node.Successor
+	node.ftLock.RUnlock()
+	for len(replicas) < node.config.Replicas {
+		if succ == nil || succ.Id == nil || seen[string(succ.Id)] {
+			// around the whole ring
+			return replicas, len(replicas)
+		}
+		seen[string(succ.Id)] = true
+		replicas = append(replicas, succ)
+		next, err := GetSuccessorId_RPC(succ)
+		if err != nil {
+			break
+		}
+		succ = next
+	}
+	return replicas, node.config.Replicas
+}
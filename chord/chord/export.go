@@ -0,0 +1,185 @@
+/*                                                                           */
+/*  Purpose: Export every key of the ring to a JSON lines file and import    */
+/*           such a file back, for backups and migrations.                   */
+/*                                                                           */
+
+package chord
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+/* How often ExportRing walks the ring again when it changed under it */
+const EXPORT_ATTEMPTS = 5
+const EXPORT_RETRY_WAIT = time.Second
+
+/* Keys ImportRing puts with one PutMany */
+const IMPORT_BATCH = 256
+
+/* Longest line ImportRing accepts */
+const IMPORT_MAX_LINE = 64 * 1024 * 1024
+
+/* One line of an export file */
+type ExportRecord struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Expires string `json:"expires,omitempty"` /* RFC 3339, absent for keys that never expire */
+}
+
+/*
+Write every key in the ring to w, one JSON ExportRecord per line, sorted by key
+
+the ring is walked by successor starting at start and every node hands over
+the keys in (predecessor, id]. The export only counts when those ranges tile
+the whole ring, no node still holds keys of another one and a second walk
+finds the same nodes, otherwise a node joined or left in between and we
+start over, up to EXPORT_ATTEMPTS times.
+Each node's range is read at once; writes racing with the export may or may
+not be in it. Returns the number of keys written.
+*/
+func ExportRing(start *RemoteNode, w io.Writer) (int, error) {
+	var err error
+	for attempt := 0; attempt < EXPORT_ATTEMPTS; attempt++ {
+		if attempt > 0 {
+			time.Sleep(EXPORT_RETRY_WAIT)
+		}
+		var records []ExportRecord
+		records, err = snapshotRing(start)
+		if err != nil {
+			continue
+		}
+
+		out := bufio.NewWriter(w)
+		enc := json.NewEncoder(out)
+		for _, rec := range records {
+			if err := enc.Encode(rec); err != nil {
+				return 0, err
+			}
+		}
+		return len(records), out.Flush()
+	}
+	return 0, err
+}
+
+/*
+Read an export file from r and put every key through client
+
+keys whose expiry already passed are skipped. Keys are written in batches of
+IMPORT_BATCH, the import stops after the first batch with a failed key. Returns the number of
+keys written.
+*/
+func ImportRing(client *Client, r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, IMPORT_MAX_LINE)
+
+	written := 0
+	var batch []KeyValue
+	var lines []int
+	flush := func() error {
+		var err error
+		for i, res := range client.PutMany(batch) {
+			if res.Err == nil {
+				written++
+			} else if err == nil {
+				err = errors.New(fmt.Sprintf("line %v: key %q: %v", lines[i], res.Key, res.Err))
+			}
+		}
+		batch, lines = batch[:0], lines[:0]
+		return err
+	}
+
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var rec ExportRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return written, errors.New(fmt.Sprintf("line %v: %v", lineNo, err))
+		}
+		var ttl time.Duration
+		if rec.Expires != "" {
+			expires, err := time.Parse(time.RFC3339Nano, rec.Expires)
+			if err != nil {
+				return written, errors.New(fmt.Sprintf("line %v: %v", lineNo, err))
+			}
+			ttl = time.Until(expires)
+			if ttl <= 0 {
+				continue
+			}
+		}
+		batch = append(batch, KeyValue{rec.Key, rec.Value, ttl})
+		lines = append(lines, lineNo)
+		if len(batch) == IMPORT_BATCH {
+			if err := flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return written, err
+	}
+	return written, flush()
+}
+
+/* One pass of ExportRing, fails when the ring is not settled */
+func snapshotRing(start *RemoteNode) ([]ExportRecord, error) {
+	report := new(RingReport)
+	nodes, err := walkRing(start, report)
+	if err != nil {
+		return nil, err
+	}
+	if !report.Ok() {
+		return nil, errors.New(fmt.Sprintf("ring is not settled: %v", report.Violations[0].Detail))
+	}
+
+	now := time.Now()
+	var records []ExportRecord
+	for i, n := range nodes {
+		reply, err := GetRange_RPC(n)
+		if err != nil {
+			return nil, err
+		}
+		prev := nodes[(i+len(nodes)-1)%len(nodes)]
+		// alone in the ring a node owns everything, whatever its predecessor
+		if len(nodes) > 1 && !EqualIds(reply.PredId, prev.Id) {
+			return nil, errors.New(fmt.Sprintf("node %v has predecessor %v, expected %v",
+				HashStr(n.Id), HashStr(reply.PredId), HashStr(prev.Id)))
+		}
+		// a key transfer is pending, the owner may not have these keys yet
+		if reply.Strays > 0 {
+			return nil, errors.New(fmt.Sprintf("node %v holds %v keys outside its range",
+				HashStr(n.Id), reply.Strays))
+		}
+		for _, kv := range reply.Entries {
+			rec := ExportRecord{Key: kv.Key, Value: kv.Value}
+			if kv.TTL > 0 {
+				rec.Expires = now.Add(kv.TTL).UTC().Format(time.RFC3339Nano)
+			}
+			records = append(records, rec)
+		}
+	}
+
+	again, err := walkRing(start, new(RingReport))
+	if err != nil {
+		return nil, err
+	}
+	if len(again) != len(nodes) {
+		return nil, errors.New("ring changed during export")
+	}
+	for i := range nodes {
+		if !EqualIds(again[i].Id, nodes[i].Id) {
+			return nil, errors.New("ring changed during export")
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+	return records, nil
+}
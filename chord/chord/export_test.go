@@ -0,0 +1,84 @@
+package chord
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	nodes := newTestRing(t, 10, 90, 170)
+	var keys []string
+	for i := 0; i < 30; i++ {
+		keys = append(keys, fmt.Sprintf("k%v", i))
+	}
+	putOnOwners(nodes, keys...)
+	for _, node := range nodes {
+		if entry, ok := node.dataStore["k0"]; ok {
+			entry.Expires = time.Now().Add(time.Hour)
+			node.dataStore["k0"] = entry
+		}
+	}
+
+	var buf bytes.Buffer
+	n, err := ExportRing(nodes[0].RemoteSelf, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(keys) || strings.Count(buf.String(), "\n") != len(keys) {
+		t.Fatalf("exported %v keys in %v lines, want %v", n, strings.Count(buf.String(), "\n"), len(keys))
+	}
+
+	for _, node := range nodes {
+		node.dataStore = make(map[string]dataEntry)
+	}
+	// routes from each node's range, the import needs no lookups
+	client := NewClient(nodes[1].RemoteSelf)
+	for _, node := range nodes {
+		client.learn(node.RemoteSelf)
+		client.cacheRange(node.RemoteSelf)
+	}
+	n, err = ImportRing(client, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(keys) {
+		t.Errorf("imported %v keys, want %v", n, len(keys))
+	}
+	for _, node := range nodes {
+		for k, entry := range node.dataStore {
+			owner := ownerOf(HashKey(k), []*RemoteNode{nodes[0].RemoteSelf, nodes[1].RemoteSelf, nodes[2].RemoteSelf})
+			if !EqualIds(owner.Id, node.Id) || entry.Value != "v-"+k {
+				t.Errorf("key %v = %q on %v, owner %v", k, entry.Value, HashStr(node.Id), HashStr(owner.Id))
+			}
+			if (k == "k0") == entry.Expires.IsZero() {
+				t.Errorf("key %v expires %v", k, entry.Expires)
+			}
+		}
+	}
+}
+
+func TestExportRefusesStrayKeys(t *testing.T) {
+	nodes := newTestRing(t, 10, 90, 170)
+	putOnOwners(nodes, "a", "b", "c")
+	// a key 90 should have handed to its owner
+	for i := 0; ; i++ {
+		if k := fmt.Sprintf("s%v", i); !BetweenRightIncl(HashKey(k), []byte{10}, []byte{90}) {
+			nodes[1].dataStore[k] = newDataEntry("v", 0)
+			break
+		}
+	}
+
+	reply, err := GetRange_RPC(nodes[1].RemoteSelf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Strays != 1 {
+		t.Errorf("range reports %v strays, want 1", reply.Strays)
+	}
+	if _, err := snapshotRing(nodes[0].RemoteSelf); err == nil || !strings.Contains(err.Error(), "outside its range") {
+		t.Errorf("snapshot with a stray key: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package chord
+
+import (
+	"testing"
+)
+
+func TestReusableFinger(t *testing.T) {
+	node := &Node{Id: []byte{10}}
+	node.FingerTable = make([]FingerEntry, KEY_LENGTH)
+	for i := range node.FingerTable {
+		node.FingerTable[i].Start = fingerMath(node.Id, i, KEY_LENGTH)
+	}
+	// starts 11, 12, 14, 18, 26, ...
+	node.FingerTable[2].Node = &RemoteNode{[]byte{20}, "b"}
+
+	if reused := node.reusableFinger(3); reused == nil || reused.Addr != "b" {
+		t.Errorf("start 18 is before node 20, got %v", reused)
+	}
+	if reused := node.reusableFinger(4); reused != nil {
+		t.Errorf("start 26 is past finger 3's node, got %v", reused)
+	}
+	if reused := node.reusableFinger(0); reused != nil {
+		t.Errorf("finger 0 has no previous entry, got %v", reused)
+	}
+}
+
+func TestGuessFingers(t *testing.T) {
+	fingers := make([]FingerEntry, KEY_LENGTH)
+	for i := range fingers {
+		fingers[i].Start = fingerMath([]byte{10}, i, KEY_LENGTH)
+	}
+	// starts 11, 12, 14, 18, 26, 42, 74, 138
+	self := &RemoteNode{[]byte{10}, "self"}
+	known := []*RemoteNode{self, {[]byte{140}, "c"}, {[]byte{20}, "a"}, {[]byte{42}, "b"}, nil}
+	guessFingers(fingers, known)
+
+	want := []string{"a", "a", "a", "a", "b", "b", "c", "c"}
+	for i, entry := range fingers {
+		if entry.Node == nil || entry.Node.Addr != want[i] {
+			t.Errorf("finger %v (start %v) guessed %v, want %v", i, HashStr(entry.Start), entry.Node, want[i])
+		}
+	}
+}
+
+func TestBootstrapFingersLeavesPredecessorToNotify(t *testing.T) {
+	nodes := newTestRing(t, 10, 200)
+	putOnOwners(nodes, "a", "b", "c", "d")
+	joining := newTestNode(t, []byte{100})
+	joining.Successor = nodes[1].RemoteSelf
+	joining.FingerTable[0].Node = nodes[1].RemoteSelf
+
+	joining.bootstrapFingers(nodes[1].RemoteSelf)
+	if joining.Predecessor != nil {
+		t.Fatalf("predecessor %v set before it notified us", HashStr(joining.Predecessor.Id))
+	}
+
+	joining.notify(nodes[0].RemoteSelf)
+	if joining.Predecessor == nil || !EqualIds(joining.Predecessor.Id, nodes[0].Id) {
+		t.Errorf("notify from 10 did not make it our predecessor")
+	}
+}
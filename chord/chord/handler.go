@@ -18,17 +18,88 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math/big"
+	"strings"
+	"time"
 )
 
+/* Start of the error validateRpc returns when a request reaches the wrong node */
+const ERR_WRONG_NODE = "Node ids do not match"
+
 /* Validate that we're executing this RPC on the intended node */
 func validateRpc(node *Node, reqId []byte) error {
 	if !bytes.Equal(node.Id, reqId) {
-		errStr := fmt.Sprintf("Node ids do not match %v, %v", node.Id, reqId)
+		errStr := fmt.Sprintf("%v %v, %v", ERR_WRONG_NODE, node.Id, reqId)
 		return errors.New(errStr)
 	}
 	return nil
 }
 
+/* Did a request fail because it reached a node other than the one it was meant for? */
+func IsWrongNodeError(err error) bool {
+	if _, ok := err.(*WrongOwnerError); ok {
+		return true
+	}
+	return err != nil && strings.HasPrefix(err.Error(), ERR_WRONG_NODE)
+}
+
+/*
+Validate that key belongs to us, i.e. hash(key) in (predecessor, us]
+
+if not, reply carries a redirect to the node we believe owns key. Without
+a predecessor we cannot tell yet and accept the key.
+*/
+func validateOwner(node *Node, key string, reply *KeyValueReply) bool {
+	node.ftLock.RLock()
+	pred := node.Predecessor
+	node.ftLock.RUnlock()
+	id := HashKey(key)
+	if pred == nil || BetweenRightIncl(id, pred.Id, node.Id) {
+		return true
+	}
+	owner := node.guessOwner(id)
+	if owner == nil {
+		return true
+	}
+	node.log.Debug("rejecting key outside our range", "key", key, "redirect", HashStr(owner.Id))
+	reply.Key = key
+	reply.RedirectId = owner.Id
+	reply.RedirectAddr = owner.Addr
+	return false
+}
+
+/*
+best local guess of successor(id): the first node at or after id among our
+successor, predecessor and fingers. No RPCs, the caller follows up.
+
+never ourselves, nil when we know of no other node.
+*/
+func (node *Node) guessOwner(id []byte) *RemoteNode {
+	node.ftLock.RLock()
+	candidates := []*RemoteNode{node.Successor, node.Predecessor}
+	for _, finger := range node.FingerTable {
+		candidates = append(candidates, finger.Node)
+	}
+	node.ftLock.RUnlock()
+
+	ring := new(big.Int).Lsh(big.NewInt(1), KEY_LENGTH)
+	target := new(big.Int).SetBytes(id)
+	var best *RemoteNode
+	var bestDist *big.Int
+	for _, n := range candidates {
+		if n == nil || EqualIds(n.Id, node.Id) {
+			continue
+		}
+		dist := new(big.Int).Sub(new(big.Int).SetBytes(n.Id), target)
+		dist.Mod(dist, ring)
+		if bestDist == nil || dist.Cmp(bestDist) < 0 {
+			best = n
+			bestDist = dist
+		}
+	}
+	return best
+}
+
 
 ////////////////////////////////////////////////////////////////////////////////////////
 ////////////////////////////////////////////////////////////////////////////////////////
@@ -47,7 +118,6 @@ RPC handler
 */
 func (node *Node) GetPredecessorId_Handler(req *RemoteId, reply *IdReply) error {
 	if err := validateRpc(node, req.Id); err != nil {
-		reply.Ok = false
 		return err
 	}
 	// Predecessor may be nil, which is okay.
@@ -75,7 +145,6 @@ return immedaite successor
 */
 func (node *Node) GetSuccessorId_Handler(req *RemoteId, reply *IdReply) error {
 	if err := validateRpc(node, req.Id); err != nil {
-		reply.Ok = false
 		return err
 	}
 	if node.Successor == nil {
@@ -91,32 +160,305 @@ func (node *Node) GetSuccessorId_Handler(req *RemoteId, reply *IdReply) error {
 }
 
 
+/* 
+RPC handler 
+
+return a copy of our finger table, used by tools that inspect the ring
+*/
+func (node *Node) GetFingerTable_Handler(req *RemoteId, reply *FingerTableReply) error {
+	if err := validateRpc(node, req.Id); err != nil {
+		return err
+	}
+	node.ftLock.RLock()
+	defer node.ftLock.RUnlock()
+	reply.Fingers = make([]FingerEntry, len(node.FingerTable))
+	copy(reply.Fingers, node.FingerTable)
+	return nil
+}
+
+
+/* 
+RPC handler 
+
+return every key in our datastore, used by tools that inspect the ring
+*/
+func (node *Node) GetKeys_Handler(req *RemoteId, reply *KeysReply) error {
+	if err := validateRpc(node, req.Id); err != nil {
+		return err
+	}
+	node.dsLock.RLock()
+	defer node.dsLock.RUnlock()
+	now := time.Now()
+	reply.Keys = make([]string, 0, len(node.dataStore))
+	for k, entry := range node.dataStore {
+		if entry.live(now) {
+			reply.Keys = append(reply.Keys, k)
+		}
+	}
+	return nil
+}
+
+
+/* 
+RPC handler 
+
+return the keys in (predecessor, id] with their values. Keys left over
+from before a join are not ours, they are only counted in reply.Strays
+*/
+func (node *Node) GetRange_Handler(req *RemoteId, reply *RangeReply) error {
+	if err := validateRpc(node, req.Id); err != nil {
+		return err
+	}
+	if node.Predecessor != nil {
+		reply.PredId = node.Predecessor.Id
+	}
+	node.dsLock.RLock()
+	defer node.dsLock.RUnlock()
+	now := time.Now()
+	for k, entry := range node.dataStore {
+		if !entry.live(now) {
+			continue
+		}
+		if reply.PredId != nil && !BetweenRightIncl(HashKey(k), reply.PredId, node.Id) {
+			reply.Strays++
+			continue
+		}
+		reply.Entries = append(reply.Entries, KeyValue{k, entry.Value, entry.ttl(now)})
+	}
+	return nil
+}
+
+
+/* 
+RPC handler 
+
+Merkle tree of our replicas in (req.From, req.To], the hashes asked for
+*/
+func (node *Node) MerkleHashes_Handler(req *MerkleReq, reply *MerkleReply) error {
+	if err := validateRpc(node, req.NodeId); err != nil {
+		return err
+	}
+	node.dsLock.RLock()
+	tree := newMerkleTree(node.replicaStore, req.From, req.To, time.Now())
+	node.dsLock.RUnlock()
+	hashes, err := tree.hashes(req.Level, req.Indexes)
+	reply.Hashes = hashes
+	return err
+}
+
+
+func (node *Node) BucketDigests_Handler(req *MerkleReq, reply *MerkleReply) error {
+	if err := validateRpc(node, req.NodeId); err != nil {
+		return err
+	}
+	node.dsLock.RLock()
+	reply.Digests = bucketDigests(node.replicaStore, req.From, req.To, req.Indexes, time.Now())
+	node.dsLock.RUnlock()
+	return nil
+}
+
+
+/* 
+RPC handler 
+
+the owner of (req.From, req.To] found our replicas stale, take its copies.
+Only versions newer than ours are taken, a write that reached us after the
+owner built its tree is kept
+*/
+func (node *Node) RepairReplica_Handler(req *RepairReq, reply *RpcOkay) error {
+	if err := validateRpc(node, req.NodeId); err != nil {
+		return err
+	}
+	node.dsLock.Lock()
+	defer node.dsLock.Unlock()
+	for _, kv := range req.Puts {
+		if !BetweenRightIncl(HashKey(kv.Key), req.From, req.To) {
+			return errors.New(fmt.Sprintf("Key %v is outside the repaired range", kv.Key))
+		}
+	}
+	for i, kv := range req.Puts {
+		entry := newDataEntry(kv.Value, kv.TTL)
+		if i < len(req.Versions) {
+			entry.Version = req.Versions[i]
+		}
+		if current, ok := node.replicaStore[kv.Key]; ok && current.Version >= entry.Version {
+			continue
+		}
+		node.replicaStore[kv.Key] = entry
+	}
+	for i, k := range req.Deletes {
+		if !BetweenRightIncl(HashKey(k), req.From, req.To) {
+			continue
+		}
+		if i < len(req.DeleteVersions) && node.replicaStore[k].Version > req.DeleteVersions[i] {
+			continue
+		}
+		delete(node.replicaStore, k)
+	}
+	reply.Ok = true
+	return nil
+}
+
+
+/* 
+RPC handler 
+
+nodes holding key, only answered by its owner
+*/
+func (node *Node) ReplicaSet_Handler(req *KeyValueReq, reply *ReplicaSetReply) error {
+	if err := validateRpc(node, req.NodeId); err != nil {
+		return err
+	}
+	var kvReply KeyValueReply
+	if !validateOwner(node, req.Key, &kvReply) {
+		reply.RedirectId = kvReply.RedirectId
+		reply.RedirectAddr = kvReply.RedirectAddr
+		return nil
+	}
+	reply.Replicas, reply.Wanted = node.replicaSet()
+	return nil
+}
+
+
+/* 
+RPC handler 
+
+read key from the datastore or, as a replica, from the replica store. A
+missing key is no error here, it is version 0 for the coordinator to compare.
+A tombstone answers with its version and reply.Deleted
+*/
+func (node *Node) GetVersioned_Handler(req *VersionedReq, reply *KeyValueReply) error {
+	if err := validateRpc(node, req.NodeId); err != nil {
+		return err
+	}
+	now := time.Now()
+	node.dsLock.RLock()
+	defer node.dsLock.RUnlock()
+	reply.Key = req.Key
+	for _, store := range []map[string]dataEntry{node.dataStore, node.replicaStore} {
+		entry, ok := store[req.Key]
+		if ok && !entry.expired(now) && entry.Version > reply.Version {
+			reply.Value = entry.Value
+			reply.TTL = entry.ttl(now)
+			reply.Version = entry.Version
+			reply.Deleted = entry.Deleted
+		}
+	}
+	return nil
+}
+
+
+/* 
+RPC handler 
+
+write key at req.Version, into the datastore if the key is ours and the
+replica store otherwise. A newer version already there is kept. With
+req.Deleted the write is a tombstone
+*/
+func (node *Node) PutVersioned_Handler(req *VersionedReq, reply *KeyValueReply) error {
+	if err := validateRpc(node, req.NodeId); err != nil {
+		return err
+	}
+	if req.TTL < 0 {
+		return errors.New(fmt.Sprintf("Negative TTL %v for key %v", req.TTL, req.Key))
+	}
+	pred := node.Predecessor
+	owned := pred == nil || BetweenRightIncl(HashKey(req.Key), pred.Id, node.Id)
+	store := node.replicaStore
+	if owned {
+		store = node.dataStore
+	}
+
+	node.dsLock.Lock()
+	current, ok := store[req.Key]
+	newer := !ok || current.Version < req.Version
+	if newer && req.Deleted {
+		store[req.Key] = newTombstone(req.Version)
+	} else if newer {
+		entry := newDataEntry(req.Value, req.TTL)
+		entry.Version = req.Version
+		store[req.Key] = entry
+	}
+	node.dsLock.Unlock()
+
+	if newer && owned && req.Deleted {
+		if ok && current.live(time.Now()) {
+			node.emitWatch(WATCH_DELETE, req.Key, "")
+		}
+	} else if newer && owned {
+		node.emitWatch(WATCH_PUT, req.Key, req.Value)
+	}
+	reply.Key = req.Key
+	return nil
+}
+
+
+/* 
+RPC handler
+
+our predecessor is leaving, its predecessor becomes ours. Only it may say so
+*/
 func (node *Node) SetPredecessorId(req *UpdateReq, reply *RpcOkay) error {
 	if err := validateRpc(node, req.FromId); err != nil {
 		reply.Ok = false
 		return err
 	}
-	node.Predecessor.Id = req.UpdateId
-	node.Predecessor.Addr = req.UpdateAddr
+	if node.Predecessor == nil || !EqualIds(node.Predecessor.Id, req.SenderId) {
+		reply.Ok = false
+		return errors.New(fmt.Sprintf("Node %v is not our predecessor", HashStr(req.SenderId)))
+	}
+	// the last other node leaving leaves us without one, notify finds the next
+	var predecessor *RemoteNode
+	if req.UpdateId != nil && !EqualIds(req.UpdateId, node.Id) {
+		predecessor = &RemoteNode{req.UpdateId, req.UpdateAddr}
+		if err := node.checkPeerId(predecessor); err != nil {
+			reply.Ok = false
+			return err
+		}
+	}
+	node.ftLock.Lock()
+	node.Predecessor = predecessor
+	node.ftLock.Unlock()
+	node.noteChurn()
 	reply.Ok = true
 	return nil
 }
 
 
+/* 
+RPC handler
+
+our successor is leaving, its successor becomes ours. Only it may say so
+*/
 func (node *Node) SetSuccessorId(req *UpdateReq, reply *RpcOkay) error {
 	if err := validateRpc(node, req.FromId); err != nil {
 		reply.Ok = false
 		return err
 	}
-	node.Successor.Id = req.UpdateId
-	node.Successor.Addr = req.UpdateAddr
+	if node.Successor == nil || !EqualIds(node.Successor.Id, req.SenderId) {
+		reply.Ok = false
+		return errors.New(fmt.Sprintf("Node %v is not our successor", HashStr(req.SenderId)))
+	}
+	successor := node.RemoteSelf
+	if req.UpdateId != nil && !EqualIds(req.UpdateId, node.Id) {
+		successor = &RemoteNode{req.UpdateId, req.UpdateAddr}
+		if err := node.checkPeerId(successor); err != nil {
+			reply.Ok = false
+			return err
+		}
+	}
+	node.ftLock.Lock()
+	node.Successor = successor
+	node.FingerTable[0].Node = successor
+	node.ftLock.Unlock()
+	node.noteChurn()
 	reply.Ok = true
 	return nil
 }
 
 
 func (node *Node) Notify_Handler(req *NotifyReq, reply *RpcOkay) error {
-	if err := validateRpc(node, query.FromId); err != nil {
+	if err := validateRpc(node, req.NodeId); err != nil {
 		reply.Ok = false
 		return err
 	}
@@ -124,6 +466,12 @@ func (node *Node) Notify_Handler(req *NotifyReq, reply *RpcOkay) error {
 	predecessor := new(RemoteNode)
 	predecessor.Id = req.UpdateId
 	predecessor.Addr = req.UpdateAddr
+	// a made up ID could sit right before a key it wants to take over
+	if err := node.checkPeerId(predecessor); err != nil {
+		node.log.Warn("refused notify", "pred", predecessor.Addr, "err", err)
+		reply.Ok = false
+		return err
+	}
 	node.notify(predecessor) // handler implementation 
 	reply.Ok = true
 
@@ -136,9 +484,9 @@ RPC handler
 
 us successor transfer data to predecessor 
 
-1. loop thru kv map to find data belongs to predecessor 
-2. rpc data to successor
-3. delete from kv map 
+1. loop thru kv map to find data in (req.PredId, req.FromId]
+2. rpc data to the node asking, our predecessor
+3. delete from kv map once it took them
 
 */
 func (node *Node) TransferKeys_Handler(req *TransferReq, reply *RpcOkay) error {
@@ -146,20 +494,61 @@ func (node *Node) TransferKeys_Handler(req *TransferReq, reply *RpcOkay) error {
 		reply.Ok = false
 		return err
 	}
-	for k,v := range node.dataStore{
-		hashed_key := HashKey(k)
-		if BetweenRightIncl(hashed_key, req.PredId, req.FromId){ // FromId == successor 
-			Put_RPC(node.Predecessor, k, v)
-			delete(node.dataStore, k)
-		}
+	// anyone else asking would take keys that are still ours
+	if node.Predecessor == nil || !EqualIds(node.Predecessor.Id, req.FromId) {
+		reply.Ok = false
+		return errors.New(fmt.Sprintf("Node %v is not our predecessor", HashStr(req.FromId)))
+	}
+	if err := node.transferKeys(req.PredId, req.FromId, &RemoteNode{req.FromId, req.FromAddr}); err != nil {
+		reply.Ok = false
+		return err
 	}
-	
 	reply.Ok = true
 
 	return nil
 }
 
 
+/* 
+RPC handler
+
+keys handed over to us as their new owner. Taken without validateOwner, the
+sender learns they are ours before we do. A newer version already here is kept,
+tombstones are kept as tombstones
+*/
+func (node *Node) HandOffKeys_Handler(req *HandOffReq, reply *RpcOkay) error {
+	if err := validateRpc(node, req.NodeId); err != nil {
+		return err
+	}
+	if len(req.Versions) != len(req.Entries) {
+		return errors.New(fmt.Sprintf("%v versions for %v keys", len(req.Versions), len(req.Entries)))
+	}
+	if req.Deleted != nil && len(req.Deleted) != len(req.Entries) {
+		return errors.New(fmt.Sprintf("%v tombstone flags for %v keys", len(req.Deleted), len(req.Entries)))
+	}
+	node.dsLock.Lock()
+	for i, kv := range req.Entries {
+		if current, ok := node.dataStore[kv.Key]; ok && current.Version >= req.Versions[i] {
+			continue
+		}
+		var entry dataEntry
+		if req.Deleted != nil && req.Deleted[i] {
+			entry = newTombstone(req.Versions[i])
+			if kv.TTL > 0 {
+				entry.Expires = time.Now().Add(kv.TTL)
+			}
+		} else {
+			entry = newDataEntry(kv.Value, kv.TTL)
+			entry.Version = req.Versions[i]
+		}
+		node.dataStore[kv.Key] = entry
+	}
+	node.dsLock.Unlock()
+	reply.Ok = true
+	return nil
+}
+
+
 ////////////////////////////////////////////////////////////////////////////////////////
 ////////////////////////////////////////////////////////////////////////////////////////
 ////////////////////////////////////////////////////////////////////////////////////////
@@ -182,20 +571,16 @@ RPC handler
 */
 func (node *Node) FindSuccessor_Handler(query *RemoteQuery, reply *IdReply) error {
 	if err := validateRpc(node, query.FromId); err != nil {
-		reply.Ok = false
 		return err
 	}
-	// check break condition, if not then recurse again
-	id = find_closest_successor(query.id) 
-	if node.Predecessor == nil {
-		reply.Id = nil
-		reply.Addr = ""
-		reply.Valid = false
-	} else {
-		reply.Id = node.FingerTable[id].Node.id 
-		reply.Addr = node.FingerTable[id].Node.Addr
-		reply.Valid = true
+	// check break condition, if not then hop on from here
+	succ, err := node.find_closest_successor(query.Id)
+	if err != nil {
+		return err
 	}
+	reply.Id = succ.Id
+	reply.Addr = succ.Addr
+	reply.Valid = true
 
 	return nil
 }
@@ -212,25 +597,230 @@ from down to up loop thru finger table
 */
 func (node *Node) ClosestPrecedingFinger_Handler(query *RemoteQuery, reply *IdReply) error {
 	if err := validateRpc(node, query.FromId); err != nil {
-		reply.Ok = false
 		return err
 	}
 	
-	for i := KEY_LENGTH; i > 0; i-=1 {		
-		if BetweenRightIncl(node.FingerTable[i].Node.Id, node.Id, query.Id) {
-			if node.Predecessor == nil { // found new node's closest predecessor 
-				reply.Id = nil
-				reply.Addr = ""
-				reply.Valid = false
-			} else { // biggest successor node that is smaller than new node == NOT closest predecessor 
-				reply.Id = node.FingerTable[i].Node.id 
-				reply.Addr = node.FingerTable[i].Node.Addr
-				reply.Valid = true
-			}
+	// biggest finger smaller than new node, or the closest by RTT among its candidates
+	node.ftLock.RLock()
+	closest := node.closestPrecedingFinger(query.Id)
+	node.ftLock.RUnlock()
+	reply.Id = closest.Id
+	reply.Addr = closest.Addr
+	reply.Valid = true
+
+	return nil
+}
+
+
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+
+/*
+for Get_RPC n Put_RPC, executed on the node that stores the key
+
+keys outside (predecessor, us] are refused with a redirect, see validateOwner
+*/
+
+/* 
+RPC handler
+
+read a key from our local datastore
+*/
+func (node *Node) GetLocal_Handler(req *KeyValueReq, reply *KeyValueReply) error {
+	if err := validateRpc(node, req.NodeId); err != nil {
+		return err
+	}
+	if !validateOwner(node, req.Key, reply) {
+		return nil
+	}
+	node.dsLock.RLock()
+	entry, ok := node.dataStore[req.Key]
+	node.dsLock.RUnlock()
+	now := time.Now()
+	if !ok || !entry.live(now) {
+		// expired keys and tombstones linger until the next sweep, never hand them out
+		return errors.New(fmt.Sprintf("Key %v not found on node %v", req.Key, HashStr(node.Id)))
+	}
+	reply.Key = req.Key
+	reply.Value = entry.Value
+	reply.TTL = entry.ttl(now)
+	return nil
+}
+
+
+/* 
+RPC handler
+
+write a key into our local datastore, expiring after req.TTL if set
+*/
+func (node *Node) PutLocal_Handler(req *KeyValueReq, reply *KeyValueReply) error {
+	if err := validateRpc(node, req.NodeId); err != nil {
+		return err
+	}
+	if !validateOwner(node, req.Key, reply) {
+		return nil
+	}
+	if req.TTL < 0 {
+		return errors.New(fmt.Sprintf("Negative TTL %v for key %v", req.TTL, req.Key))
+	}
+	node.dsLock.Lock()
+	node.dataStore[req.Key] = newDataEntry(req.Value, req.TTL)
+	node.dsLock.Unlock()
+	node.emitWatch(WATCH_PUT, req.Key, req.Value)
+	reply.Key = req.Key
+	reply.Value = req.Value
+	reply.TTL = req.TTL
+	return nil
+}
+
+
+/* 
+RPC handler
+
+remove a key from our local datastore, deleting a missing key is not an error.
+With replicas a tombstone stays behind, so stale replicas cannot bring it back
+*/
+func (node *Node) DeleteLocal_Handler(req *KeyValueReq, reply *KeyValueReply) error {
+	if err := validateRpc(node, req.NodeId); err != nil {
+		return err
+	}
+	if !validateOwner(node, req.Key, reply) {
+		return nil
+	}
+	node.dsLock.Lock()
+	entry, ok := node.dataStore[req.Key]
+	existed := ok && entry.live(time.Now())
+	if node.config.Replicas > 1 {
+		node.dataStore[req.Key] = newTombstone(time.Now().UnixNano())
+	} else {
+		delete(node.dataStore, req.Key)
+	}
+	node.dsLock.Unlock()
+	if existed {
+		node.emitWatch(WATCH_DELETE, req.Key, "")
+	}
+	reply.Key = req.Key
+	return nil
+}
+
+
+/* 
+RPC handler
+
+GetLocal_Handler for every key of a batch, errors are reported per key
+*/
+func (node *Node) GetLocalMany_Handler(req *KeyValueBatchReq, reply *KeyValueBatchReply) error {
+	return node.handleBatch(req, reply, node.GetLocal_Handler)
+}
+
+
+/* 
+RPC handler
+
+PutLocal_Handler for every key of a batch, errors are reported per key
+*/
+func (node *Node) PutLocalMany_Handler(req *KeyValueBatchReq, reply *KeyValueBatchReply) error {
+	return node.handleBatch(req, reply, node.PutLocal_Handler)
+}
+
+
+func (node *Node) handleBatch(req *KeyValueBatchReq, reply *KeyValueBatchReply,
+	handler func(*KeyValueReq, *KeyValueReply) error) error {
+	if err := validateRpc(node, req.NodeId); err != nil {
+		return err
+	}
+	reply.Replies = make([]KeyValueReply, len(req.Reqs))
+	reply.Errors = make([]string, len(req.Reqs))
+	for i := range req.Reqs {
+		if err := handler(&req.Reqs[i], &reply.Replies[i]); err != nil {
+			reply.Errors[i] = err.Error()
 		}
 	}
+	return nil
+}
+
+
 
+/* 
+RPC handler
+
+nothing but a round trip, for measuring RTTs
+*/
+func (node *Node) Ping_Handler(req *RemoteId, reply *RpcOkay) error {
+	if err := validateRpc(node, req.Id); err != nil {
+		return err
+	}
+	reply.Ok = true
+	return nil
+}
 
 
+
+/* 
+RPC handler
+
+version handshake on a new connection, refused when we cannot work together
+*/
+func (node *Node) Hello_Handler(req *HelloReq, reply *HelloReply) error {
+	if err := compatible(req.Version, req.MinVersion); err != nil {
+		node.log.Warn("refused handshake", "version", req.Version, "min", req.MinVersion)
+		return err
+	}
+	reply.Version = PROTOCOL_VERSION
+	reply.MinVersion = MIN_PROTOCOL_VERSION
+	reply.Capabilities = CAPABILITIES
+	return nil
+}
+
+
+
+/* 
+RPC handler
+
+register a watch, key watches only on the key's owner
+*/
+func (node *Node) Watch_Handler(req *WatchReq, reply *WatchReply) error {
+	if err := validateRpc(node, req.NodeId); err != nil {
+		return err
+	}
+	if !req.Prefix {
+		var kvReply KeyValueReply
+		if !validateOwner(node, req.Key, &kvReply) {
+			reply.RedirectId = kvReply.RedirectId
+			reply.RedirectAddr = kvReply.RedirectAddr
+			return nil
+		}
+	}
+	node.addWatch(req.SubId, req.Key, req.Prefix)
+	return nil
+}
+
+
+/* 
+RPC handler
+
+long-poll for events of a watch, returns after req.Wait at the latest
+*/
+func (node *Node) PollWatch_Handler(req *PollWatchReq, reply *PollWatchReply) error {
+	if err := validateRpc(node, req.NodeId); err != nil {
+		return err
+	}
+	node.pollWatch(req.SubId, req.After, req.Wait, reply)
+	return nil
+}
+
+
+func (node *Node) Unwatch_Handler(req *PollWatchReq, reply *RpcOkay) error {
+	if err := validateRpc(node, req.NodeId); err != nil {
+		return err
+	}
+	node.removeWatch(req.SubId)
+	reply.Ok = true
 	return nil
 }
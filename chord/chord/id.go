@@ -0,0 +1,155 @@
+/*                                                                           */
+/*  Purpose: Node IDs that peers can check, derived from a node's address or */
+/*           from the public key of its TLS certificate.                     */
+/*                                                                           */
+
+package chord
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+/* How a node's ID has to be derived for its peers to accept it */
+type IdScheme int
+
+const (
+	ID_SCHEME_ANY        IdScheme = iota /* Any ID, nothing is checked */
+	ID_SCHEME_ADDRESS                    /* HashKey of the advertised address, guards against misconfiguration only */
+	ID_SCHEME_PUBLIC_KEY                 /* HashKey of the TLS certificate's public key, needs Config.TLS */
+)
+
+func (scheme IdScheme) String() string {
+	switch scheme {
+	case ID_SCHEME_ANY:
+		return "any"
+	case ID_SCHEME_ADDRESS:
+		return "address"
+	case ID_SCHEME_PUBLIC_KEY:
+		return "key"
+	}
+	return fmt.Sprintf("IdScheme(%d)", int(scheme))
+}
+
+/* "any", "address" or "key" */
+func ParseIdScheme(s string) (IdScheme, error) {
+	switch strings.ToLower(s) {
+	case "any":
+		return ID_SCHEME_ANY, nil
+	case "address":
+		return ID_SCHEME_ADDRESS, nil
+	case "key":
+		return ID_SCHEME_PUBLIC_KEY, nil
+	}
+	return 0, errors.New(fmt.Sprintf("unknown ID scheme %q, expected any, address or key", s))
+}
+
+/* ID of the node holding cert's private key under ID_SCHEME_PUBLIC_KEY */
+func PublicKeyId(cert *x509.Certificate) []byte {
+	return HashKey(string(cert.RawSubjectPublicKeyInfo))
+}
+
+/* Key-derived IDs of the peers we dialed over TLS, by address. The handshake proved the key */
+var peerKeyIds = make(map[string][]byte)
+var peerKeyIdsLock sync.RWMutex
+
+func rememberPeerKey(addr string, cert *x509.Certificate) {
+	peerKeyIdsLock.Lock()
+	peerKeyIds[addr] = PublicKeyId(cert)
+	peerKeyIdsLock.Unlock()
+}
+
+/*
+ID of a new node listening on addr
+
+definedId, when set, has to agree with what the scheme derives. Over TLS
+the ID named in our certificate is ours, peers check it; under
+ID_SCHEME_PUBLIC_KEY the certificate needs no ID, the key decides.
+*/
+func chooseId(addr string, definedId []byte, scheme IdScheme, cert *x509.Certificate) ([]byte, error) {
+	var fixed []byte
+	switch scheme {
+	case ID_SCHEME_ADDRESS:
+		fixed = HashKey(addr)
+	case ID_SCHEME_PUBLIC_KEY:
+		if cert == nil {
+			return nil, errors.New("ID scheme key needs TLS to be configured")
+		}
+		fixed = PublicKeyId(cert)
+	}
+	if cert != nil {
+		named, err := certId(cert)
+		if err != nil {
+			return nil, err
+		}
+		if named == nil && fixed == nil {
+			return nil, errors.New(fmt.Sprintf("certificate carries no %v: ID", CERT_ID_SCHEME))
+		}
+		if named != nil && fixed != nil && !EqualIds(named, fixed) {
+			return nil, errors.New(fmt.Sprintf("certificate names node %v, ID scheme %v derives %v",
+				HashStr(named), scheme, HashStr(fixed)))
+		}
+		if fixed == nil {
+			fixed = named
+		}
+	}
+
+	switch {
+	case fixed == nil && definedId == nil:
+		return HashKey(addr), nil
+	case fixed == nil:
+		return definedId, nil
+	case definedId != nil && !EqualIds(definedId, fixed):
+		return nil, errors.New(fmt.Sprintf("ID %v was asked for, but ours has to be %v", HashStr(definedId), HashStr(fixed)))
+	}
+	return fixed, nil
+}
+
+/*
+Check that peer's ID is derived the way our ID scheme wants
+
+under either scheme the peer is then contacted at its address under its
+ID, which validateRpc on its side refuses unless both are really its own.
+Under ID_SCHEME_PUBLIC_KEY the TLS handshake of that call also proves it
+holds the key its ID is derived from.
+
+ID_SCHEME_ADDRESS only keeps out misconfigured nodes: with KEY_LENGTH bits
+an address hashing to any wanted ID is found in a few hundred tries.
+*/
+func (node *Node) checkPeerId(peer *RemoteNode) error {
+	if peer == nil || EqualIds(peer.Id, node.Id) {
+		return nil
+	}
+	switch node.config.IdScheme {
+	case ID_SCHEME_ADDRESS:
+		if !EqualIds(peer.Id, HashKey(peer.Addr)) {
+			return errors.New(fmt.Sprintf("ID %v of %v is not derived from its address", HashStr(peer.Id), peer.Addr))
+		}
+		if _, err := GetSuccessorId_RPC(peer); err != nil {
+			return errors.New(fmt.Sprintf("node %v does not answer at %v: %v", HashStr(peer.Id), peer.Addr, err))
+		}
+	case ID_SCHEME_PUBLIC_KEY:
+		if _, err := GetSuccessorId_RPC(peer); err != nil {
+			return err
+		}
+		peerKeyIdsLock.RLock()
+		keyId := peerKeyIds[peer.Addr]
+		peerKeyIdsLock.RUnlock()
+		if !EqualIds(peer.Id, keyId) {
+			return errors.New(fmt.Sprintf("ID %v of %v is not derived from its public key", HashStr(peer.Id), peer.Addr))
+		}
+	}
+	return nil
+}
+
+/* checkPeerId for a node about to go into our finger table, logging a refusal */
+func (node *Node) acceptFinger(peer *RemoteNode) bool {
+	if err := node.checkPeerId(peer); err != nil {
+		node.log.Warn("refused finger", "peer", peer.Addr, "err", err)
+		return false
+	}
+	return true
+}
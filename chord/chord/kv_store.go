@@ -8,9 +8,62 @@
 package chord
 
 import (
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 )
 
+/*
+How long a deleted key is remembered when keys are replicated, long enough
+for anti-entropy and read repair to carry the delete to every replica
+*/
+const TOMBSTONE_TTL = 10 * time.Minute
+
+/* Value held in a node's datastore */
+type dataEntry struct {
+	Value   string
+	Expires time.Time /* Zero for keys that never expire */
+	Version int64     /* Write time in ns, the newer version wins between replicas */
+	Deleted bool      /* Tombstone of a delete at Version, dropped once Expires passes */
+}
+
+/* Entry for value living ttl from now, 0 never expires, versioned now */
+func newDataEntry(value string, ttl time.Duration) dataEntry {
+	entry := dataEntry{Value: value, Version: time.Now().UnixNano()}
+	if ttl > 0 {
+		entry.Expires = time.Now().Add(ttl)
+	}
+	return entry
+}
+
+/* Tombstone of a delete at version, expires after TOMBSTONE_TTL */
+func newTombstone(version int64) dataEntry {
+	return dataEntry{Expires: time.Now().Add(TOMBSTONE_TTL), Version: version, Deleted: true}
+}
+
+func (entry dataEntry) expired(now time.Time) bool {
+	return !entry.Expires.IsZero() && !now.Before(entry.Expires)
+}
+
+/* Holds a value, neither deleted nor expired */
+func (entry dataEntry) live(now time.Time) bool {
+	return !entry.Deleted && !entry.expired(now)
+}
+
+/* Time left to live, 0 for entries that never expire */
+func (entry dataEntry) ttl(now time.Time) time.Duration {
+	if entry.Expires.IsZero() {
+		return 0
+	}
+	left := entry.Expires.Sub(now)
+	if left <= 0 {
+		// already expired, the smallest TTL keeps it from turning into "forever"
+		return time.Nanosecond
+	}
+	return left
+}
+
 /*                             */
 /* client level library / External API Into Datastore */
 /*                             */
@@ -19,16 +72,33 @@ import (
 func Get(node *Node, key string) (string, error) {
 	
 	dest_node, err := node.locate(key)
-	value := Get_RPC(dest_node, key)
-
-	return value, nil
+	if err != nil {
+		return "", err
+	}
+	return Get_RPC(dest_node, key)
 }
 
 /* Put a key/value in the datastore, provided an abitrary node in the ring */
 func Put(node *Node, key string, value string) error {
 
-	Put_RPC(node, key, value)
-	return nil
+	dest_node, err := node.locate(key)
+	if err != nil {
+		return err
+	}
+	return Put_RPC(dest_node, key, value)
+}
+
+
+/* Put a key/value that expires after ttl, provided an abitrary node in the ring */
+func PutWithTTL(node *Node, key string, value string, ttl time.Duration) error {
+	if ttl < 0 {
+		return errors.New("TTL must not be negative")
+	}
+	dest_node, err := node.locate(key)
+	if err != nil {
+		return err
+	}
+	return PutTTL_RPC(dest_node, key, value, ttl)
 }
 
 
@@ -36,12 +106,10 @@ func Put(node *Node, key string, value string) error {
 func (node *Node) locate(key string) (*RemoteNode, error) {
 
 	// 1. hash key into object id 
-	object_id = HashKey(key)
+	object_id := HashKey(key)
 
 	// 2. successor of object_id == node that stores key
-	node = FindSuccessor_RPC(object_id)
-
-	return node, nil
+	return node.find_closest_successor(object_id)
 }
 
 
@@ -60,25 +128,166 @@ func (node *Node) locate(key string) (*RemoteNode, error) {
 
 /* Print the contents of a node's data store */
 func PrintDataStore(node *Node) {
-	fmt.Printf("Node-%v datastore: %v\n", HashStr(node.Id), node.dataStore)
+	node.dsLock.RLock()
+	defer node.dsLock.RUnlock()
+	now := time.Now()
+	values := make(map[string]string)
+	for k, entry := range node.dataStore {
+		if entry.Deleted {
+			continue
+		}
+		if entry.Expires.IsZero() {
+			values[k] = entry.Value
+		} else {
+			values[k] = fmt.Sprintf("%v (ttl %v)", entry.Value, entry.ttl(now).Truncate(time.Millisecond))
+		}
+	}
+	fmt.Printf("Node-%v datastore: %v\n", HashStr(node.Id), values)
+}
+
+
+/*
+Thread 4: periodically drop keys whose TTL ran out
+
+GetLocal_Handler already hides expired keys, this frees the memory and
+tells watchers. Tombstones go the same way, silently. Watches nobody polls
+anymore are dropped here too.
+*/
+func (node *Node) sweepExpired(ticker *time.Ticker) {
+	for _ = range ticker.C {
+		if node.IsShutdown {
+			ticker.Stop()
+			return
+		}
+		now := time.Now()
+		var expired []string
+		node.dsLock.Lock()
+		for k, entry := range node.dataStore {
+			if !entry.expired(now) {
+				continue
+			}
+			delete(node.dataStore, k)
+			if !entry.Deleted {
+				expired = append(expired, k)
+			}
+		}
+		for k, entry := range node.replicaStore {
+			if entry.expired(now) {
+				delete(node.replicaStore, k)
+			}
+		}
+		node.dsLock.Unlock()
+		for _, k := range expired {
+			node.emitWatch(WATCH_EXPIRE, k, "")
+		}
+		node.expireIdleWatches(now)
+		if len(expired) > 0 {
+			keysExpiredTotal.add(float64(len(expired)), HashStr(node.Id))
+			node.log.Debug("expired keys", "count", len(expired))
+		}
+	}
 }
 
 
 
+/*
+Hand our keys in (from, to] over to dest, their new owner
+
+the keys are copied under dsLock and sent without it. Once dest took them,
+only the ones nobody wrote meanwhile are deleted, on error they all stay for
+the next try. TTLs travel as time left to live, expired keys are dropped
+instead of sent. Tombstones go along with their versions, so a replica still
+holding the deleted value cannot bring it back; a dest too old to keep
+tombstones gets the live keys alone.
+*/
+func (node *Node) transferKeys(from []byte, to []byte, dest *RemoteNode) error {
+	if dest == nil || EqualIds(dest.Id, node.Id) {
+		return nil
+	}
+	node.dsLock.RLock()
+	now := time.Now()
+	moving := make(map[string]dataEntry)
+	var entries []KeyValue
+	var versions []int64
+	var deleted []bool
+	tombstones := 0
+	for k, v := range node.dataStore {
+		if !BetweenRightIncl(HashKey(k), from, to) {
+			continue
+		}
+		moving[k] = v
+		if !v.expired(now) {
+			entries = append(entries, KeyValue{k, v.Value, v.ttl(now)})
+			versions = append(versions, v.Version)
+			deleted = append(deleted, v.Deleted)
+			if v.Deleted {
+				tombstones++
+			}
+		}
+	}
+	node.dsLock.RUnlock()
+
+	if tombstones == 0 {
+		deleted = nil
+	}
+	if len(entries) > 0 {
+		err := HandOffKeys_RPC(dest, node.RemoteSelf, entries, versions, deleted)
+		if err != nil && tombstones > 0 && strings.HasPrefix(err.Error(), ERR_UNSUPPORTED) {
+			// dest keeps no tombstones, it would take them for empty values
+			var live []KeyValue
+			var liveVersions []int64
+			for i := range entries {
+				if !deleted[i] {
+					live = append(live, entries[i])
+					liveVersions = append(liveVersions, versions[i])
+				}
+			}
+			entries, err = live, nil
+			if len(entries) > 0 {
+				err = HandOffKeys_RPC(dest, node.RemoteSelf, entries, liveVersions, nil)
+			}
+		}
+		if err != nil {
+			node.log.Warn("key transfer failed, keeping the keys", "dest", dest.Addr, "keys", len(entries), "err", err)
+			return err
+		}
+		keysTransferredTotal.add(float64(len(entries)), HashStr(node.Id))
+	}
+
+	node.dsLock.Lock()
+	for k, sent := range moving {
+		// written while we were sending, dest has an older version than ours
+		if v, ok := node.dataStore[k]; !ok || v.Version != sent.Version {
+			continue
+		}
+		// we are the new owner's successor, so its first replica
+		if node.config.Replicas > 1 {
+			node.replicaStore[k] = sent
+		}
+		delete(node.dataStore, k)
+	}
+	node.dsLock.Unlock()
+
+	// registers watches on dest, reads and writes go on meanwhile
+	node.migrateWatches(from, to, dest)
+	return nil
+}
+
+
 /* Creates a Chord node with a pre-defined ID (useful for testing) */
 func CreateDefinedNode(parent *RemoteNode, definedId []byte) (*Node, error) {
-	node := new(Node)
-	err := node.init(parent, definedId)
-	if err != nil {
-		return nil, err
-	}
-	return node, err
+	return CreateNodeWithConfig(parent, definedId, DefaultConfig())
 }
 
 /* Create Chord node with random ID based on listener address */
 func CreateNode(parent *RemoteNode) (*Node, error) {
+	return CreateNodeWithConfig(parent, nil, DefaultConfig())
+}
+
+/* Create Chord node with custom settings, definedId may be nil for an address based ID */
+func CreateNodeWithConfig(parent *RemoteNode, definedId []byte, config *Config) (*Node, error) {
 	node := new(Node)
-	err := node.init(parent, nil)
+	err := node.init(parent, definedId, config)
 	if err != nil {
 		return nil, err
 	}
@@ -89,23 +298,22 @@ func CreateNode(parent *RemoteNode) (*Node, error) {
 /* Shutdown a specified Chord node (gracefully) */
 func ShutdownNode(node *Node) {
 	node.IsShutdown = true
+	// watchers keep polling us until the listener closes, tell them where to go
+	node.handOffWatches(node.Successor)
 	// Wait for go routines to quit, should be enough time.
 	time.Sleep(time.Millisecond * 2000)
 	node.Listener.Close()
+	if node.AdminListener != nil {
+		node.AdminListener.Close()
+	}
 
 	// 1. u() immediate predecessor's immediate successor n immediate successor's immediate predecessor
-	SetSuccessorId_RPC(node.Predecessor, node.Successor)
-	SetPredecessorId_RPC(node.Successor, node.Predecessor)
+	SetSuccessorId_RPC(node.Predecessor, node.RemoteSelf, node.Successor)
+	SetPredecessorId_RPC(node.Successor, node.RemoteSelf, node.Predecessor)
 
-	// 2. us as predecessor transfer ALL our data to our successor 
-	node.dsLock.Lock()
-	for k,v := range node.dataStore {
-		Put_RPC(node.succesor, k, v)
-		// 3. delete kv map
-		delete(node.dataStore, k)
+	// 2. us as predecessor transfer ALL our data to our successor, (id, id] is the whole ring
+	if err := node.transferKeys(node.Id, node.Id, node.Successor); err != nil {
+		node.log.Warn("keys lost on shutdown", "succ", node.Successor.Addr, "err", err)
 	}
-	node.dsLock.Unlock()
-	
-
 }
 
@@ -0,0 +1,177 @@
+package chord
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNotifyTransfersNewPredecessorsKeys(t *testing.T) {
+	nodes := newTestRing(t, 10, 200)
+	var keys []string
+	for i := 0; i < 40; i++ {
+		keys = append(keys, fmt.Sprintf("k%v", i))
+	}
+	putOnOwners(nodes, keys...)
+
+	// 100 joins between 10 and 200, taking (10, 100] from 200
+	joining := newTestNode(t, []byte{100})
+	joining.Successor = nodes[1].RemoteSelf
+	nodes[1].notify(joining.RemoteSelf)
+
+	if !EqualIds(nodes[1].Predecessor.Id, joining.Id) {
+		t.Fatalf("predecessor of 200 is %v, want 100", HashStr(nodes[1].Predecessor.Id))
+	}
+	ring := []*Node{nodes[0], joining, nodes[1]}
+	for _, k := range keys {
+		holders := []string{}
+		for _, node := range ring {
+			if _, ok := node.dataStore[k]; ok {
+				holders = append(holders, HashStr(node.Id))
+			}
+		}
+		owner := ownerOf(HashKey(k), []*RemoteNode{nodes[0].RemoteSelf, joining.RemoteSelf, nodes[1].RemoteSelf})
+		if len(holders) != 1 || holders[0] != HashStr(owner.Id) {
+			t.Errorf("key %v (hash %v) on %v, want only on %v", k, HashStr(HashKey(k)), holders, HashStr(owner.Id))
+		}
+	}
+
+	// a notify that changes nothing moves nothing
+	before := len(nodes[1].dataStore)
+	nodes[1].notify(joining.RemoteSelf)
+	if len(nodes[1].dataStore) != before {
+		t.Errorf("repeated notify moved %v keys", before-len(nodes[1].dataStore))
+	}
+}
+
+func TestDataEntryTTL(t *testing.T) {
+	now := time.Now()
+	forever := dataEntry{Value: "v"}
+	if forever.expired(now.Add(24*time.Hour)) || forever.ttl(now) != 0 {
+		t.Errorf("entry without Expires: expired %v, ttl %v", forever.expired(now), forever.ttl(now))
+	}
+	living := dataEntry{Value: "v", Expires: now.Add(time.Minute)}
+	if living.expired(now) || living.ttl(now) != time.Minute {
+		t.Errorf("entry with a minute left: expired %v, ttl %v", living.expired(now), living.ttl(now))
+	}
+	if !living.expired(now.Add(time.Minute)) {
+		t.Errorf("entry not expired at its Expires")
+	}
+	// past its time it still travels with a TTL, 0 would mean forever
+	if ttl := living.ttl(now.Add(time.Hour)); ttl <= 0 {
+		t.Errorf("expired entry has ttl %v", ttl)
+	}
+}
+
+func TestSweepExpired(t *testing.T) {
+	node := newTestRing(t, 50)[0]
+	node.addWatch("w", "old", false)
+	node.dataStore["old"] = dataEntry{Value: "v", Expires: time.Now().Add(-time.Second)}
+	node.dataStore["new"] = newDataEntry("v", time.Hour)
+	node.replicaStore["old"] = dataEntry{Value: "v", Expires: time.Now().Add(-time.Second)}
+	go node.sweepExpired(time.NewTicker(time.Millisecond))
+
+	var reply PollWatchReply
+	node.pollWatch("w", 0, time.Second, &reply)
+	if len(reply.Events) != 1 || reply.Events[0].Type != WATCH_EXPIRE || reply.Events[0].Key != "old" {
+		t.Fatalf("watch got %v, want the expiry of old", reply.Events)
+	}
+	node.dsLock.RLock()
+	defer node.dsLock.RUnlock()
+	if _, ok := node.dataStore["old"]; ok {
+		t.Errorf("expired key still stored")
+	}
+	if _, ok := node.replicaStore["old"]; ok {
+		t.Errorf("expired replica still stored")
+	}
+	if _, ok := node.dataStore["new"]; !ok {
+		t.Errorf("living key swept")
+	}
+}
+
+func TestTransferKeysKeepsKeysOnError(t *testing.T) {
+	node := newTestRing(t, 50)[0]
+	putOnOwners([]*Node{node}, "a", "b", "c")
+	gone := newTestNode(t, []byte{100})
+	gone.Listener.Close()
+
+	if err := node.transferKeys(node.Id, node.Id, gone.RemoteSelf); err == nil {
+		t.Fatal("transfer to a closed node succeeded")
+	}
+	if len(node.dataStore) != 3 {
+		t.Errorf("%v keys left after a failed transfer, want 3", len(node.dataStore))
+	}
+}
+
+func TestTransferKeysSendsTombstones(t *testing.T) {
+	node := newTestRing(t, 50)[0]
+	node.config.Replicas = 3
+	putOnOwners([]*Node{node}, "live")
+	node.dataStore["deleted"] = newTombstone(42)
+	node.dataStore["expired"] = dataEntry{Value: "v", Expires: time.Now().Add(-time.Second), Version: 1}
+	dest := newTestNode(t, []byte{100})
+
+	if err := node.transferKeys(node.Id, node.Id, dest.RemoteSelf); err != nil {
+		t.Fatal(err)
+	}
+	if entry := dest.dataStore["live"]; !entry.live(time.Now()) || entry.Value != "v-live" {
+		t.Errorf("live key arrived as %+v", entry)
+	}
+	entry, ok := dest.dataStore["deleted"]
+	if !ok || !entry.Deleted || entry.Version != 42 || entry.ttl(time.Now()) > TOMBSTONE_TTL {
+		t.Errorf("tombstone arrived as %+v", entry)
+	}
+	if _, ok := dest.dataStore["expired"]; ok {
+		t.Errorf("expired key sent")
+	}
+	// a newer write on dest wins over the tombstone handed over later
+	dest.dataStore["deleted"] = dataEntry{Value: "again", Version: 43}
+	node.dataStore["deleted"] = newTombstone(42)
+	if err := node.transferKeys(node.Id, node.Id, dest.RemoteSelf); err != nil {
+		t.Fatal(err)
+	}
+	if dest.dataStore["deleted"].Deleted {
+		t.Errorf("older tombstone replaced a newer value")
+	}
+}
+
+func TestTransferKeysToNodeWithoutTombstones(t *testing.T) {
+	node := newTestRing(t, 50)[0]
+	putOnOwners([]*Node{node}, "live")
+	node.dataStore["deleted"] = newTombstone(42)
+	dest := newTestNode(t, []byte{100})
+	if _, err := cachedClient(dest.RemoteSelf); err != nil {
+		t.Fatal(err)
+	}
+	peerProtocolsLock.Lock()
+	peerProtocols[dest.Addr] = &PeerProtocol{PROTOCOL_VERSION, []string{CAP_HANDOFF}}
+	peerProtocolsLock.Unlock()
+
+	if err := node.transferKeys(node.Id, node.Id, dest.RemoteSelf); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dest.dataStore["live"]; !ok {
+		t.Errorf("live key not handed over")
+	}
+	if entry, ok := dest.dataStore["deleted"]; ok {
+		t.Errorf("tombstone reached a node without %v as %+v", CAP_DELETE, entry)
+	}
+}
+
+func TestGuessOwnerNeverSelf(t *testing.T) {
+	lone := newTestRing(t, 50)[0]
+	if owner := lone.guessOwner(HashKey("k")); owner != nil {
+		t.Errorf("node alone in the ring guessed %v", HashStr(owner.Id))
+	}
+
+	nodes := newTestRing(t, 10, 70, 130, 200)
+	for i := 0; i < 40; i++ {
+		id := HashKey(fmt.Sprintf("k%v", i))
+		for _, node := range nodes {
+			owner := node.guessOwner(id)
+			if owner == nil || EqualIds(owner.Id, node.Id) {
+				t.Errorf("%v guessed %v as owner of %v", HashStr(node.Id), owner, HashStr(id))
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+/*                                                                           */
+/*  Purpose: Structured, leveled logging. Library code logs through a       */
+/*           Logger injected by the caller and never exits the process.      */
+/*                                                                           */
+
+package chord
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelOff
+)
+
+var levelNames = []string{"debug", "info", "warn", "error", "off"}
+
+func (level LogLevel) String() string {
+	if level < LevelDebug || level > LevelOff {
+		return fmt.Sprintf("level(%d)", int(level))
+	}
+	return levelNames[level]
+}
+
+/* Parse "debug", "info", "warn", "error" or "off" */
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+/*
+Structured logger
+
+kv are alternating key/value pairs attached to the message. With returns a
+logger that adds kv to every message, nodes use it to tag their ID and address.
+*/
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+	With(kv ...interface{}) Logger
+}
+
+/*
+Logger writing one logfmt line per message to out, dropping messages below level
+
+	time=2015-02-03T10:00:00.000Z level=info msg="joined ring" node=42 succ=87
+*/
+func NewLogger(out io.Writer, level LogLevel) Logger {
+	return &textLogger{out: out, level: level, lock: new(sync.Mutex)}
+}
+
+/* Logger that drops everything */
+func NopLogger() Logger {
+	return NewLogger(ioutil.Discard, LevelOff)
+}
+
+type textLogger struct {
+	out    io.Writer
+	level  LogLevel
+	fields []interface{}
+	lock   *sync.Mutex /* Shared with loggers derived through With */
+}
+
+func (l *textLogger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *textLogger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *textLogger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *textLogger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+func (l *textLogger) With(kv ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &textLogger{out: l.out, level: l.level, fields: fields, lock: l.lock}
+}
+
+func (l *textLogger) log(level LogLevel, msg string, kv []interface{}) {
+	if level < l.level {
+		return
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "time=%v level=%v msg=%v",
+		time.Now().UTC().Format("2006-01-02T15:04:05.000Z"), level, logValue(msg))
+	writeFields(&buf, l.fields)
+	writeFields(&buf, kv)
+	buf.WriteByte('\n')
+
+	l.lock.Lock()
+	l.out.Write(buf.Bytes())
+	l.lock.Unlock()
+}
+
+func writeFields(buf *bytes.Buffer, kv []interface{}) {
+	for i := 0; i < len(kv); i += 2 {
+		if i+1 == len(kv) {
+			fmt.Fprintf(buf, " %v=<missing>", kv[i])
+		} else {
+			fmt.Fprintf(buf, " %v=%v", kv[i], logValue(kv[i+1]))
+		}
+	}
+}
+
+/* Quote values that would otherwise break the key=value format */
+func logValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
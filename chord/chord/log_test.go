@@ -0,0 +1,52 @@
+package chord
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLoggerFiltersLevels(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LevelWarn)
+	logger.Debug("debug")
+	logger.Info("info")
+	logger.Warn("warn")
+	logger.Error("error")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "level=warn msg=warn") ||
+		!strings.Contains(lines[1], "level=error msg=error") {
+		t.Errorf("at warn got %q", lines)
+	}
+
+	buf.Reset()
+	NewLogger(&buf, LevelOff).Error("error")
+	if buf.Len() != 0 {
+		t.Errorf("off logger wrote %q", buf.String())
+	}
+}
+
+func TestLoggerFormatsFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LevelDebug).With("node", 42)
+	logger.Info("joined ring", "succ", 87, "addr", "", "err", `bad "thing"`, "odd")
+
+	line := strings.TrimSpace(buf.String())
+	if !strings.HasPrefix(line, "time=") {
+		t.Errorf("line without time: %q", line)
+	}
+	want := ` level=info msg="joined ring" node=42 succ=87 addr="" err="bad \"thing\"" odd=<missing>`
+	if !strings.HasSuffix(line, want) {
+		t.Errorf("got  %q\nwant suffix %q", line, want)
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	if level, err := ParseLogLevel("WARN"); err != nil || level != LevelWarn {
+		t.Errorf("WARN parsed as %v, %v", level, err)
+	}
+	if _, err := ParseLogLevel("loud"); err == nil {
+		t.Errorf("unknown level parsed")
+	}
+}
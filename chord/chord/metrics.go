@@ -0,0 +1,278 @@
+/*                                                                           */
+/*  Purpose: Counters and histograms for RPCs and ring health, exposed in    */
+/*           the Prometheus text exposition format.                          */
+/*                                                                           */
+
+package chord
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/rpc"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Histogram buckets, in seconds for durations */
+var latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+var hopBuckets = []float64{0, 1, 2, 3, 4, 5, 6, 8, 10, 12, 16}
+
+/* Every metric of this package, shared by all nodes in the process and labelled by node */
+var (
+	rpcHandledTotal = newCounterVec("chord_rpc_handled_total",
+		"RPCs handled by this process, by node, handler and result.", "node", "method", "result")
+	rpcHandleSeconds = newHistogramVec("chord_rpc_handle_seconds",
+		"Time spent handling an RPC, by node and handler.", latencyBuckets, "node", "method")
+	rpcClientErrorsTotal = newCounterVec("chord_rpc_client_errors_total",
+		"Outgoing RPCs that failed, by peer address and method.", "peer", "method")
+	lookupHops = newHistogramVec("chord_lookup_hops",
+		"Finger table hops taken to find the closest predecessor of an id.", hopBuckets, "node")
+	stabilizeSeconds = newHistogramVec("chord_stabilize_seconds",
+		"Duration of one stabilize round.", latencyBuckets, "node")
+	keysTransferredTotal = newCounterVec("chord_keys_transferred_total",
+		"Keys handed to another node by TransferKeys or shutdown.", "node")
+	keysExpiredTotal = newCounterVec("chord_keys_expired_total",
+		"Keys removed by the expiry sweeper after their TTL ran out.", "node")
+	rpcOverloadedTotal = newCounterVec("chord_rpc_overloaded_total",
+		"RPCs refused because a connection, concurrency or rate limit was reached, by node and handler.", "node", "method")
+	keysRepairedTotal = newCounterVec("chord_keys_repaired_total",
+		"Keys put or deleted on a replica by anti-entropy.", "node")
+)
+
+var allMetrics []*metricVec
+
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+
+/*
+Write every metric in the Prometheus text format
+
+nodes are the local nodes whose key counts should be reported as the
+chord_keys_stored gauge.
+*/
+func WriteMetrics(w io.Writer, nodes ...*Node) {
+	for _, vec := range allMetrics {
+		vec.write(w)
+	}
+
+	fmt.Fprintf(w, "# HELP chord_keys_stored Keys currently held in a node's datastore.\n")
+	fmt.Fprintf(w, "# TYPE chord_keys_stored gauge\n")
+	for _, node := range nodes {
+		node.dsLock.RLock()
+		count := len(node.dataStore)
+		node.dsLock.RUnlock()
+		fmt.Fprintf(w, "chord_keys_stored{node=\"%v\"} %v\n", HashStr(node.Id), count)
+	}
+	fmt.Fprintf(w, "# HELP chord_replica_keys_stored Replicas of other nodes' keys held by a node.\n")
+	fmt.Fprintf(w, "# TYPE chord_replica_keys_stored gauge\n")
+	for _, node := range nodes {
+		node.dsLock.RLock()
+		count := len(node.replicaStore)
+		node.dsLock.RUnlock()
+		fmt.Fprintf(w, "chord_replica_keys_stored{node=\"%v\"} %v\n", HashStr(node.Id), count)
+	}
+
+	connLock.Lock()
+	conns := len(connMap)
+	connLock.Unlock()
+	fmt.Fprintf(w, "# HELP chord_rpc_connections Cached outgoing RPC connections.\n")
+	fmt.Fprintf(w, "# TYPE chord_rpc_connections gauge\n")
+	fmt.Fprintf(w, "chord_rpc_connections %v\n", conns)
+}
+
+/* A named family of counters or histograms, one series per label value combination */
+type metricVec struct {
+	name    string
+	help    string
+	kind    string /* "counter" or "histogram" */
+	labels  []string
+	buckets []float64 /* Upper bounds, histograms only */
+	lock    sync.Mutex
+	series  map[string]*metricSeries
+}
+
+type metricSeries struct {
+	values []string
+	value  float64  /* Counter value */
+	counts []uint64 /* Per bucket counts (not cumulative), histograms only */
+	sum    float64
+	count  uint64
+}
+
+func newCounterVec(name, help string, labels ...string) *metricVec {
+	vec := &metricVec{name: name, help: help, kind: "counter", labels: labels}
+	vec.series = make(map[string]*metricSeries)
+	allMetrics = append(allMetrics, vec)
+	return vec
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *metricVec {
+	vec := &metricVec{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets}
+	vec.series = make(map[string]*metricSeries)
+	allMetrics = append(allMetrics, vec)
+	return vec
+}
+
+/* Series for values, created on first use. Caller holds vec.lock */
+func (vec *metricVec) with(values []string) *metricSeries {
+	key := strings.Join(values, "\xff")
+	s, ok := vec.series[key]
+	if !ok {
+		s = &metricSeries{values: values}
+		if vec.kind == "histogram" {
+			s.counts = make([]uint64, len(vec.buckets))
+		}
+		vec.series[key] = s
+	}
+	return s
+}
+
+func (vec *metricVec) inc(values ...string) {
+	vec.add(1, values...)
+}
+
+func (vec *metricVec) add(delta float64, values ...string) {
+	vec.lock.Lock()
+	vec.with(values).value += delta
+	vec.lock.Unlock()
+}
+
+func (vec *metricVec) observe(v float64, values ...string) {
+	vec.lock.Lock()
+	s := vec.with(values)
+	for i, bound := range vec.buckets {
+		if v <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+	vec.lock.Unlock()
+}
+
+func (vec *metricVec) observeSince(start time.Time, values ...string) {
+	vec.observe(time.Since(start).Seconds(), values...)
+}
+
+func (vec *metricVec) write(w io.Writer) {
+	vec.lock.Lock()
+	defer vec.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %v %v\n", vec.name, vec.help)
+	fmt.Fprintf(w, "# TYPE %v %v\n", vec.name, vec.kind)
+	keys := make([]string, 0, len(vec.series))
+	for k := range vec.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := vec.series[k]
+		if vec.kind == "counter" {
+			fmt.Fprintf(w, "%v%v %v\n", vec.name, formatLabels(vec.labels, s.values, "", ""), formatValue(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range vec.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%v_bucket%v %v\n", vec.name,
+				formatLabels(vec.labels, s.values, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%v_bucket%v %v\n", vec.name, formatLabels(vec.labels, s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", vec.name, formatLabels(vec.labels, s.values, "", ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%v_count%v %v\n", vec.name, formatLabels(vec.labels, s.values, "", ""), s.count)
+	}
+}
+
+/* {a="1",b="2"} with an optional extra label appended, "" when there are no labels */
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%v=\"%v\"", name, escapeLabel(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%v=\"%v\"", extraName, escapeLabel(extraValue)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(v string) string {
+	v = strings.Replace(v, "\\", "\\\\", -1)
+	v = strings.Replace(v, "\"", "\\\"", -1)
+	return strings.Replace(v, "\n", "\\n", -1)
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+
+/*
+Server codec wrapper timing every handler
+
+a request is started when its header is read and finished when its
+response is written, both keyed by the request's sequence number.
+*/
+type metricsServerCodec struct {
+	rpc.ServerCodec
+	node    string
+	lock    sync.Mutex
+	pending map[uint64]pendingCall
+}
+
+type pendingCall struct {
+	method string
+	start  time.Time
+}
+
+func newMetricsServerCodec(node *Node, codec rpc.ServerCodec) rpc.ServerCodec {
+	return &metricsServerCodec{ServerCodec: codec, node: HashStr(node.Id), pending: make(map[uint64]pendingCall)}
+}
+
+func (codec *metricsServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := codec.ServerCodec.ReadRequestHeader(r)
+	if err == nil {
+		codec.lock.Lock()
+		codec.pending[r.Seq] = pendingCall{handlerName(r.ServiceMethod), time.Now()}
+		codec.lock.Unlock()
+	}
+	return err
+}
+
+func (codec *metricsServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	codec.lock.Lock()
+	call, ok := codec.pending[r.Seq]
+	delete(codec.pending, r.Seq)
+	codec.lock.Unlock()
+
+	if ok {
+		result := "ok"
+		if r.Error != "" {
+			result = "error"
+		}
+		rpcHandledTotal.inc(codec.node, call.method, result)
+		rpcHandleSeconds.observeSince(call.start, codec.node, call.method)
+	}
+	return codec.ServerCodec.WriteResponse(r, body)
+}
+
+/* "host:port.Method" -> "Method" */
+func handlerName(serviceMethod string) string {
+	return serviceMethod[strings.LastIndex(serviceMethod, ".")+1:]
+}
@@ -0,0 +1,37 @@
+package chord
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetricsTextFormat(t *testing.T) {
+	counter := newCounterVec("test_total", "A test counter.", "node")
+	counter.inc("1")
+	counter.add(2, "1")
+	hist := newHistogramVec("test_seconds", "A test histogram.", []float64{1, 2}, "node")
+	hist.observe(0.5, "1")
+	hist.observe(1.5, "1")
+	hist.observe(5, "1")
+
+	var buf bytes.Buffer
+	counter.write(&buf)
+	hist.write(&buf)
+	out := buf.String()
+
+	for _, line := range []string{
+		"# TYPE test_total counter",
+		`test_total{node="1"} 3`,
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{node="1",le="1"} 1`,
+		`test_seconds_bucket{node="1",le="2"} 2`,
+		`test_seconds_bucket{node="1",le="+Inf"} 3`,
+		`test_seconds_sum{node="1"} 7`,
+		`test_seconds_count{node="1"} 3`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in output:\n%v", line, out)
+		}
+	}
+}
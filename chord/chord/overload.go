@@ -0,0 +1,270 @@
+/*                                                                           */
+/*  Purpose: Limits on connections, requests in flight and request rates,    */
+/*           globally and per peer, with an error clients back off on.       */
+/*                                                                           */
+
+package chord
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Error prefix of requests refused because a limit was reached */
+const ERR_OVERLOADED = "Node overloaded"
+
+/* Error prefix of requests on a connection over Config.MaxConns, which is hung up soon after */
+const ERR_TOO_MANY_CONNS = ERR_OVERLOADED + ": too many connections"
+
+/* Calls refused as overloaded are tried this many more times, backing off */
+const OVERLOAD_RETRIES = 4
+
+/* First backoff, doubled on every retry, plus up to as much again in jitter */
+const OVERLOAD_BACKOFF = 25 * time.Millisecond
+
+/* How long a connection over Config.MaxConns is kept to refuse its requests */
+const OVERLOAD_CONN_GRACE = time.Second
+
+/* Peers without connections or requests for this long are forgotten */
+const PEER_IDLE_TIMEOUT = time.Minute
+
+/* Long-polls wait rather than work, they don't count as in flight */
+var longPollMethods = map[string]bool{
+	"PollWatch_Handler": true,
+}
+
+/* Did a call fail because the remote node was overloaded? Safe to retry, the handler never ran */
+func IsOverloadedError(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), ERR_OVERLOADED)
+}
+
+/* Wait before retry number attempt (from 0) of an overloaded call */
+func overloadBackoff(attempt int) time.Duration {
+	backoff := OVERLOAD_BACKOFF << uint(attempt)
+	return backoff + time.Duration(rand.Int63n(int64(backoff)))
+}
+
+/* Requests per second with bursts of up to a second's worth, at least one */
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (bucket *tokenBucket) take(rate float64, now time.Time) bool {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	if bucket.last.IsZero() {
+		bucket.tokens = burst
+	} else {
+		bucket.tokens += rate * now.Sub(bucket.last).Seconds()
+		if bucket.tokens > burst {
+			bucket.tokens = burst
+		}
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+/* What one peer has open on a node */
+type peerLoad struct {
+	conns    int
+	inFlight int
+	rate     tokenBucket
+	lastSeen time.Time
+}
+
+/*
+Everything a node has open, checked against its Config limits
+
+a peer is a remote host, so several nodes or clients on one machine share
+the per-peer limits. Limits of 0 are not enforced.
+*/
+type loadLimiter struct {
+	config   *Config
+	lock     sync.Mutex
+	conns    int
+	inFlight int
+	rate     tokenBucket
+	peers    map[string]*peerLoad
+	pruned   time.Time
+}
+
+func newLoadLimiter(config *Config) *loadLimiter {
+	return &loadLimiter{config: config, peers: make(map[string]*peerLoad)}
+}
+
+/* Entry for peer, created on first use. Caller holds limiter.lock */
+func (limiter *loadLimiter) peer(peer string, now time.Time) *peerLoad {
+	if now.Sub(limiter.pruned) > PEER_IDLE_TIMEOUT {
+		for p, load := range limiter.peers {
+			if load.conns == 0 && load.inFlight == 0 && now.Sub(load.lastSeen) > PEER_IDLE_TIMEOUT {
+				delete(limiter.peers, p)
+			}
+		}
+		limiter.pruned = now
+	}
+	load, ok := limiter.peers[peer]
+	if !ok {
+		load = new(peerLoad)
+		limiter.peers[peer] = load
+	}
+	load.lastSeen = now
+	return load
+}
+
+/* Count a new connection from peer, false if that would be one too many */
+func (limiter *loadLimiter) openConn(peer string) bool {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	if limiter.config.MaxConns > 0 && limiter.conns >= limiter.config.MaxConns {
+		return false
+	}
+	limiter.conns++
+	limiter.peer(peer, time.Now()).conns++
+	return true
+}
+
+func (limiter *loadLimiter) closeConn(peer string) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.conns--
+	limiter.peer(peer, time.Now()).conns--
+}
+
+/*
+Let a request from peer in, or say which limit it hit
+
+admitted requests are in flight until release, unless counted is false.
+*/
+func (limiter *loadLimiter) admit(peer string, counted bool) error {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	config := limiter.config
+	now := time.Now()
+	load := limiter.peer(peer, now)
+
+	if counted && config.MaxInFlight > 0 && limiter.inFlight >= config.MaxInFlight {
+		return errors.New(fmt.Sprintf("%v: %v requests in flight", ERR_OVERLOADED, limiter.inFlight))
+	}
+	if counted && config.MaxInFlightPerPeer > 0 && load.inFlight >= config.MaxInFlightPerPeer {
+		return errors.New(fmt.Sprintf("%v: %v requests in flight from %v", ERR_OVERLOADED, load.inFlight, peer))
+	}
+	// the peer's rate first, so a peer over it doesn't use up everyone else's
+	if config.RequestRatePerPeer > 0 && !load.rate.take(config.RequestRatePerPeer, now) {
+		return errors.New(fmt.Sprintf("%v: over %v requests/s from %v", ERR_OVERLOADED, config.RequestRatePerPeer, peer))
+	}
+	if config.RequestRate > 0 && !limiter.rate.take(config.RequestRate, now) {
+		return errors.New(fmt.Sprintf("%v: over %v requests/s", ERR_OVERLOADED, config.RequestRate))
+	}
+	if counted {
+		limiter.inFlight++
+		load.inFlight++
+	}
+	return nil
+}
+
+func (limiter *loadLimiter) release(peer string) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.inFlight--
+	limiter.peer(peer, time.Now()).inFlight--
+}
+
+/* Host part of a connection's remote address */
+func peerHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+
+/*
+Server codec refusing requests over the node's limits
+
+a request is admitted once its body is read, so the stream stays in step,
+and leaves flight when its response is written. Refused requests get an
+ERR_OVERLOADED error without reaching their handler, every request on a
+connection that was one too many is.
+*/
+type limitServerCodec struct {
+	rpc.ServerCodec
+	node     *Node
+	peer     string
+	tooMany  bool /* Connection is over Config.MaxConns */
+	lock     sync.Mutex
+	admitted map[uint64]bool /* Requests in flight, by sequence number */
+	seq      uint64          /* Of the request whose body is read next */
+	method   string
+}
+
+func newLimitServerCodec(node *Node, peer string, codec rpc.ServerCodec, tooMany bool) rpc.ServerCodec {
+	return &limitServerCodec{ServerCodec: codec, node: node, peer: peer, tooMany: tooMany, admitted: make(map[uint64]bool)}
+}
+
+func (codec *limitServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := codec.ServerCodec.ReadRequestHeader(r)
+	codec.seq = r.Seq
+	codec.method = handlerName(r.ServiceMethod)
+	return err
+}
+
+func (codec *limitServerCodec) ReadRequestBody(body interface{}) error {
+	if err := codec.ServerCodec.ReadRequestBody(body); err != nil || body == nil {
+		return err
+	}
+	if codec.tooMany {
+		rpcOverloadedTotal.inc(HashStr(codec.node.Id), codec.method)
+		return errors.New(fmt.Sprintf("%v, over %v", ERR_TOO_MANY_CONNS, codec.node.config.MaxConns))
+	}
+	counted := !longPollMethods[codec.method]
+	if err := codec.node.load.admit(codec.peer, counted); err != nil {
+		rpcOverloadedTotal.inc(HashStr(codec.node.Id), codec.method)
+		return err
+	}
+	if counted {
+		codec.lock.Lock()
+		codec.admitted[codec.seq] = true
+		codec.lock.Unlock()
+	}
+	return nil
+}
+
+func (codec *limitServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	codec.lock.Lock()
+	admitted := codec.admitted[r.Seq]
+	delete(codec.admitted, r.Seq)
+	codec.lock.Unlock()
+	if admitted {
+		codec.node.load.release(codec.peer)
+	}
+	return codec.ServerCodec.WriteResponse(r, body)
+}
+
+/* Requests still in flight when the connection goes away must not hold their slot */
+func (codec *limitServerCodec) Close() error {
+	codec.lock.Lock()
+	for seq := range codec.admitted {
+		delete(codec.admitted, seq)
+		codec.node.load.release(codec.peer)
+	}
+	codec.lock.Unlock()
+	return codec.ServerCodec.Close()
+}
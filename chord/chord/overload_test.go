@@ -0,0 +1,102 @@
+package chord
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var bucket tokenBucket
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		if !bucket.take(10, now) {
+			t.Fatalf("request %v of a burst of 10 refused", i)
+		}
+	}
+	if bucket.take(10, now) {
+		t.Errorf("11th request of the burst accepted")
+	}
+	if !bucket.take(10, now.Add(100*time.Millisecond)) {
+		t.Errorf("refused after a token was refilled")
+	}
+}
+
+func TestLoadLimiter(t *testing.T) {
+	limiter := newLoadLimiter(&Config{MaxInFlight: 3, MaxInFlightPerPeer: 2})
+	if limiter.admit("a", true) != nil || limiter.admit("a", true) != nil {
+		t.Fatalf("first two requests of a refused")
+	}
+	if err := limiter.admit("a", true); !IsOverloadedError(err) {
+		t.Errorf("third request of a: %v, want overloaded", err)
+	}
+	if err := limiter.admit("a", false); err != nil {
+		t.Errorf("uncounted request of a refused: %v", err)
+	}
+	if err := limiter.admit("b", true); err != nil {
+		t.Errorf("first request of b refused: %v", err)
+	}
+	if err := limiter.admit("c", true); !IsOverloadedError(err) {
+		t.Errorf("fourth request in flight: %v, want overloaded", err)
+	}
+	limiter.release("a")
+	if err := limiter.admit("c", true); err != nil {
+		t.Errorf("request after a release refused: %v", err)
+	}
+}
+
+func TestClosedConnectionIsRedialled(t *testing.T) {
+	node := newTestRing(t, 50)[0]
+	client, err := cachedClient(node.RemoteSelf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as if the node hung up
+	client.Close()
+	if _, err := GetSuccessorId_RPC(node.RemoteSelf); err != nil {
+		t.Fatalf("call after the connection closed: %v", err)
+	}
+	connLock.Lock()
+	redialled := connMap[node.Addr]
+	connLock.Unlock()
+	if redialled == nil || redialled == client {
+		t.Errorf("closed client still cached")
+	}
+}
+
+func TestConnectionOverMaxConnsIsDropped(t *testing.T) {
+	node := newTestRing(t, 50)[0]
+	node.config.MaxConns = 1
+	occupant, err := net.Dial("tcp", node.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		node.load.lock.Lock()
+		conns := node.load.conns
+		node.load.lock.Unlock()
+		if conns == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("occupying connection never counted")
+		}
+	}
+
+	var reply IdReply
+	if err := remoteCall(node.RemoteSelf, "GetSuccessorId_Handler", RemoteId{node.Id}, &reply); !IsOverloadedError(err) {
+		t.Fatalf("call over MaxConns: %v, want overloaded", err)
+	}
+	connLock.Lock()
+	_, cached := connMap[node.Addr]
+	connLock.Unlock()
+	if cached {
+		t.Errorf("connection over MaxConns left in connMap")
+	}
+
+	// once a slot is free, the retries get a connection of their own
+	occupant.Close()
+	if _, err := GetSuccessorId_RPC(node.RemoteSelf); err != nil {
+		t.Errorf("call after a connection was freed: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+/*                                                                           */
+/*  Purpose: Proximity-aware fingers. Several candidates are kept per finger */
+/*           interval and lookups hop to the one with the lowest RTT that    */
+/*           still makes progress.                                           */
+/*                                                                           */
+
+package chord
+
+import (
+	"sync"
+	"time"
+)
+
+/* Weight of a new ping in a peer's smoothed RTT */
+const RTT_SMOOTHING = 0.25
+
+/* RTT assumed for candidates never pinged, so any measured one wins */
+const RTT_UNKNOWN = time.Hour
+
+/* Smoothed round trip times to the nodes we ping, by address */
+type rttTable struct {
+	lock sync.RWMutex
+	rtts map[string]time.Duration
+}
+
+func (table *rttTable) observe(addr string, rtt time.Duration) {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	if table.rtts == nil {
+		table.rtts = make(map[string]time.Duration)
+	}
+	old, ok := table.rtts[addr]
+	if !ok {
+		table.rtts[addr] = rtt
+		return
+	}
+	table.rtts[addr] = old + time.Duration(RTT_SMOOTHING*float64(rtt-old))
+}
+
+/* Drop what we know of addr, it counts as never pinged until the next ping */
+func (table *rttTable) forget(addr string) {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	delete(table.rtts, addr)
+}
+
+/* RTT to addr, RTT_UNKNOWN if it was never pinged */
+func (table *rttTable) get(addr string) time.Duration {
+	table.lock.RLock()
+	defer table.lock.RUnlock()
+	if rtt, ok := table.rtts[addr]; ok {
+		return rtt
+	}
+	return RTT_UNKNOWN
+}
+
+/*
+Nodes in finger i's interval [Start, next Start), beginning with succ, the
+successor of Start
+
+walks successors until Config.FingerCandidates are found or the interval
+ends, pinging each. Called without ftLock held.
+*/
+func (node *Node) fingerCandidates(i int, succ *RemoteNode) []*RemoteNode {
+	node.ftLock.RLock()
+	start := node.FingerTable[i].Start
+	end := node.Id
+	if i+1 < len(node.FingerTable) {
+		end = node.FingerTable[i+1].Start
+	}
+	node.ftLock.RUnlock()
+
+	candidates := []*RemoteNode{}
+	seen := map[string]bool{}
+	for succ != nil && len(candidates) < node.config.FingerCandidates && !seen[succ.Addr] {
+		// the interval is [start, end), the successor of start may lie past it
+		if !EqualIds(succ.Id, start) && !Between(succ.Id, start, end) {
+			break
+		}
+		seen[succ.Addr] = true
+		if err := node.ping(succ); err != nil {
+			node.log.Debug("finger candidate unreachable", "peer", succ.Addr, "err", err)
+			node.rtts.forget(succ.Addr)
+		} else {
+			candidates = append(candidates, succ)
+		}
+		next, err := GetSuccessorId_RPC(succ)
+		if err != nil {
+			break
+		}
+		succ = next
+	}
+	return candidates
+}
+
+/*
+Measure the RTT to remote into node.rtts
+
+the connection is opened before the clock starts, the first ping on a new
+one would count the dial and handshake too.
+*/
+func (node *Node) ping(remote *RemoteNode) error {
+	if EqualIds(remote.Id, node.Id) {
+		node.rtts.observe(remote.Addr, 0)
+		return nil
+	}
+	if _, err := cachedClient(remote); err != nil {
+		return err
+	}
+	start := time.Now()
+	if err := Ping_RPC(remote); err != nil {
+		return err
+	}
+	node.rtts.observe(remote.Addr, time.Since(start))
+	return nil
+}
+
+/*
+Node to hop to from us towards id: from the highest finger down, the finger
+node or candidate in (our id, id) with the lowest RTT. Ourselves if none is
+
+without candidates this is the paper's closest_preceding_finger. Caller
+holds ftLock.
+*/
+func (node *Node) closestPrecedingFinger(id []byte) *RemoteNode {
+	for i := len(node.FingerTable) - 1; i >= 0; i-- {
+		entry := &node.FingerTable[i]
+		var best *RemoteNode
+		bestRtt := RTT_UNKNOWN
+		for _, choice := range append([]*RemoteNode{entry.Node}, entry.candidates...) {
+			if choice == nil || !Between(choice.Id, node.Id, id) {
+				continue
+			}
+			if rtt := node.rtts.get(choice.Addr); best == nil || rtt < bestRtt {
+				best, bestRtt = choice, rtt
+			}
+		}
+		if best != nil {
+			return best
+		}
+	}
+	return node.RemoteSelf
+}
@@ -0,0 +1,99 @@
+package chord
+
+import (
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+func TestClosestPrecedingFingerByRtt(t *testing.T) {
+	node := &Node{Id: []byte{10}}
+	node.RemoteSelf = &RemoteNode{node.Id, "self"}
+	node.FingerTable = make([]FingerEntry, KEY_LENGTH)
+	for i := range node.FingerTable {
+		node.FingerTable[i].Start = fingerMath(node.Id, i, KEY_LENGTH)
+		node.FingerTable[i].Node = node.RemoteSelf
+	}
+	near := &RemoteNode{[]byte{80}, "near"}
+	far := &RemoteNode{[]byte{74}, "far"}
+	past := &RemoteNode{[]byte{100}, "past"}
+	// finger 6 covers [74, 138)
+	node.FingerTable[6].Node = far
+	node.rtts.observe("far", 80*time.Millisecond)
+	node.rtts.observe("near", 2*time.Millisecond)
+	node.rtts.observe("past", time.Millisecond)
+
+	if got := node.closestPrecedingFinger([]byte{90}); got != far {
+		t.Errorf("without candidates hopped to %v, want the finger", got.Addr)
+	}
+	node.FingerTable[6].candidates = []*RemoteNode{far, near, past}
+	if got := node.closestPrecedingFinger([]byte{90}); got != near {
+		t.Errorf("hopped to %v, want the closest candidate before the id", got.Addr)
+	}
+	if got := node.closestPrecedingFinger([]byte{11}); got != node.RemoteSelf {
+		t.Errorf("no finger precedes 11, hopped to %v", got.Addr)
+	}
+}
+
+func TestRttSmoothing(t *testing.T) {
+	var table rttTable
+	if table.get("a") != RTT_UNKNOWN {
+		t.Errorf("RTT of a node never pinged is known")
+	}
+	table.observe("a", 100*time.Millisecond)
+	table.observe("a", 20*time.Millisecond)
+	if got := table.get("a"); got != 80*time.Millisecond {
+		t.Errorf("smoothed RTT %v, want 80ms", got)
+	}
+}
+
+func TestPingLeavesOutTheDial(t *testing.T) {
+	node := newTestNode(t, []byte{10})
+	remote := newTestNode(t, []byte{20})
+	// a second address for remote whose connections are served only after a while
+	slow, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	rpc.RegisterName(slow.Addr().String(), remote)
+	go func() {
+		for {
+			conn, err := slow.Accept()
+			if err != nil {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+			go remote.serveConn(conn)
+		}
+	}()
+
+	target := &RemoteNode{remote.Id, slow.Addr().String()}
+	if err := node.ping(target); err != nil {
+		t.Fatal(err)
+	}
+	if rtt := node.rtts.get(target.Addr); rtt >= 100*time.Millisecond {
+		t.Errorf("first ping measured %v, the dial included", rtt)
+	}
+}
+
+func TestFailedHopForgetsRtt(t *testing.T) {
+	nodes := newTestRing(t, 10, 200)
+	gone := newTestNode(t, []byte{100})
+	gone.Listener.Close()
+	nodes[0].rtts.observe(gone.Addr, time.Millisecond)
+	for i := range nodes[0].FingerTable {
+		nodes[0].FingerTable[i].candidates = []*RemoteNode{gone.RemoteSelf}
+	}
+
+	if _, err := nodes[0].find_closest_predecessor([]byte{250}); err == nil {
+		t.Fatalf("lookup through a dead candidate succeeded")
+	}
+	if rtt := nodes[0].rtts.get(gone.Addr); rtt != RTT_UNKNOWN {
+		t.Errorf("dead candidate still has RTT %v", rtt)
+	}
+	if got := nodes[0].closestPrecedingFinger([]byte{250}); got != nodes[1].RemoteSelf {
+		t.Errorf("next hop is %v, want 200 now", got.Addr)
+	}
+}
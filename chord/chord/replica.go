@@ -0,0 +1,286 @@
+/*                                                                           */
+/*  Purpose: Replicas of our keys on the next successors, kept in sync by    */
+/*           comparing Merkle trees and sending only the keys that differ.   */
+/*                                                                           */
+
+package chord
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+)
+
+/* Levels below the root of a Merkle tree, the leaves split the id space in 2^depth buckets */
+const MERKLE_DEPTH = 6
+
+/*
+Merkle tree over the keys of one range of a datastore
+
+leaf i hashes the keys whose id falls in the i-th of 2^depth equal slices of
+the id space, internal nodes hash their two children. Only values are
+hashed: TTLs are sent along on repair but a TTL that differs by itself does
+not make a replica stale. Tombstones count as missing keys.
+*/
+type merkleTree struct {
+	depth  int
+	levels [][][]byte /* levels[d] holds the 2^d hashes of depth d, levels[0][0] is the root */
+}
+
+func merkleDepth() int {
+	if MERKLE_DEPTH > KEY_LENGTH {
+		return KEY_LENGTH
+	}
+	return MERKLE_DEPTH
+}
+
+/* Leaf of the tree the id of key falls in */
+func merkleBucket(key string, depth int) int {
+	id := new(big.Int).SetBytes(HashKey(key))
+	return int(id.Rsh(id, uint(KEY_LENGTH-depth)).Int64())
+}
+
+/* Hash of a single value, what replicas compare key by key */
+func valueDigest(value string) []byte {
+	sum := sha1.Sum([]byte(value))
+	return sum[:]
+}
+
+/* Build the tree over the keys of store in (from, to]. Caller holds dsLock */
+func newMerkleTree(store map[string]dataEntry, from []byte, to []byte, now time.Time) *merkleTree {
+	depth := merkleDepth()
+	buckets := make([][]string, 1<<uint(depth))
+	for k, entry := range store {
+		if !entry.live(now) || !BetweenRightIncl(HashKey(k), from, to) {
+			continue
+		}
+		b := merkleBucket(k, depth)
+		buckets[b] = append(buckets[b], k)
+	}
+
+	tree := &merkleTree{depth: depth, levels: make([][][]byte, depth+1)}
+	leaves := make([][]byte, len(buckets))
+	for i, keys := range buckets {
+		sort.Strings(keys)
+		h := sha1.New()
+		for _, k := range keys {
+			h.Write([]byte(k))
+			h.Write([]byte{0})
+			h.Write(valueDigest(store[k].Value))
+		}
+		leaves[i] = h.Sum(nil)
+	}
+	tree.levels[depth] = leaves
+	for d := depth - 1; d >= 0; d-- {
+		below := tree.levels[d+1]
+		level := make([][]byte, len(below)/2)
+		for i := range level {
+			h := sha1.New()
+			h.Write(below[2*i])
+			h.Write(below[2*i+1])
+			level[i] = h.Sum(nil)
+		}
+		tree.levels[d] = level
+	}
+	return tree
+}
+
+/* Hashes of the given nodes at level */
+func (tree *merkleTree) hashes(level int, indexes []int) ([][]byte, error) {
+	if level < 0 || level > tree.depth {
+		return nil, errors.New(fmt.Sprintf("Merkle tree has no level %v", level))
+	}
+	out := make([][]byte, len(indexes))
+	for i, idx := range indexes {
+		if idx < 0 || idx >= len(tree.levels[level]) {
+			return nil, errors.New(fmt.Sprintf("Merkle tree level %v has no node %v", level, idx))
+		}
+		out[i] = tree.levels[level][idx]
+	}
+	return out, nil
+}
+
+/* Digest of every key of store in (from, to] that falls in one of buckets. Caller holds dsLock */
+func bucketDigests(store map[string]dataEntry, from []byte, to []byte, buckets []int, now time.Time) map[string][]byte {
+	wanted := make(map[int]bool)
+	for _, b := range buckets {
+		wanted[b] = true
+	}
+	depth := merkleDepth()
+	digests := make(map[string][]byte)
+	for k, entry := range store {
+		if !entry.live(now) || !BetweenRightIncl(HashKey(k), from, to) || !wanted[merkleBucket(k, depth)] {
+			continue
+		}
+		digests[k] = valueDigest(entry.Value)
+	}
+	return digests
+}
+
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+
+/*
+Thread 5: anti-entropy, only runs with config.Replicas > 1
+
+our keys in (predecessor, id] are replicated on the next Replicas-1
+successors. Every round we
+ 1. take over replicas that fell into our own range, i.e. keys of a
+    predecessor that died or did not finish handing its keys over
+ 2. compare our tree with each replica's and repair what differs
+ 3. drop replicas of ranges we no longer back up
+*/
+func (node *Node) antiEntropy(ticker *time.Ticker) {
+	for _ = range ticker.C {
+		if node.IsShutdown {
+			ticker.Stop()
+			return
+		}
+		pred := node.Predecessor
+		if pred == nil || EqualIds(pred.Id, node.Id) {
+			continue
+		}
+		node.promoteReplicas(pred.Id)
+
+		replicas, _ := node.replicaSet()
+		for _, replica := range replicas[1:] {
+			if err := node.repairReplica(replica, pred.Id, node.Id); err != nil {
+				node.log.Warn("anti-entropy failed", "replica", replica.Addr, "err", err)
+			}
+		}
+
+		node.dropStaleReplicas(pred)
+	}
+}
+
+/* Move replicas in (predId, id] into the datastore, unless we have a newer version */
+func (node *Node) promoteReplicas(predId []byte) {
+	node.dsLock.Lock()
+	promoted := 0
+	for k, entry := range node.replicaStore {
+		if !BetweenRightIncl(HashKey(k), predId, node.Id) {
+			continue
+		}
+		if current, ok := node.dataStore[k]; !ok || current.Version < entry.Version {
+			node.dataStore[k] = entry
+			promoted++
+		}
+		delete(node.replicaStore, k)
+	}
+	node.dsLock.Unlock()
+	if promoted > 0 {
+		node.log.Info("took over replicated keys", "count", promoted)
+	}
+}
+
+/*
+bring replica's copy of (from, to] in line with our datastore
+
+walks both trees down from the root one level per RPC, only into nodes
+whose hashes differ, then compares the differing leaves key by key. Keys we
+do not have are deleted at the version of our tombstone, or of the tree if
+we have none, so writes newer than what we compared survive.
+*/
+func (node *Node) repairReplica(replica *RemoteNode, from []byte, to []byte) error {
+	now := time.Now()
+	node.dsLock.RLock()
+	tree := newMerkleTree(node.dataStore, from, to, now)
+	node.dsLock.RUnlock()
+
+	differing := []int{0}
+	for level := 0; level <= tree.depth && len(differing) > 0; level++ {
+		theirs, err := MerkleHashes_RPC(replica, from, to, level, differing)
+		if err != nil {
+			return err
+		}
+		ours, _ := tree.hashes(level, differing)
+		var next []int
+		for i, idx := range differing {
+			if bytes.Equal(ours[i], theirs[i]) {
+				continue
+			}
+			if level == tree.depth {
+				next = append(next, idx)
+			} else {
+				next = append(next, 2*idx, 2*idx+1)
+			}
+		}
+		differing = next
+	}
+	if len(differing) == 0 {
+		return nil
+	}
+
+	theirs, err := BucketDigests_RPC(replica, from, to, differing)
+	if err != nil {
+		return err
+	}
+	var puts []KeyValue
+	var versions []int64
+	var deletes []string
+	var deleteVersions []int64
+	node.dsLock.RLock()
+	for k, digest := range bucketDigests(node.dataStore, from, to, differing, now) {
+		if !bytes.Equal(digest, theirs[k]) {
+			entry := node.dataStore[k]
+			puts = append(puts, KeyValue{k, entry.Value, entry.ttl(now)})
+			versions = append(versions, entry.Version)
+		}
+		delete(theirs, k)
+	}
+	for k := range theirs {
+		version := now.UnixNano()
+		if entry, ok := node.dataStore[k]; ok && entry.Deleted {
+			version = entry.Version
+		}
+		deletes = append(deletes, k)
+		deleteVersions = append(deleteVersions, version)
+	}
+	node.dsLock.RUnlock()
+
+	if len(puts) == 0 && len(deletes) == 0 {
+		return nil
+	}
+	if err := RepairReplica_RPC(replica, from, to, puts, versions, deletes, deleteVersions); err != nil {
+		return err
+	}
+	keysRepairedTotal.add(float64(len(puts)+len(deletes)), HashStr(node.Id))
+	node.log.Debug("repaired replica", "replica", replica.Addr, "buckets", len(differing),
+		"puts", len(puts), "deletes", len(deletes))
+	return nil
+}
+
+/*
+drop replicas outside the ranges of our Replicas-1 predecessors
+
+those predecessors' ranges together are (p, pred] where p is the Replicas-th
+predecessor. Nothing is dropped when a predecessor cannot be asked.
+*/
+func (node *Node) dropStaleReplicas(pred *RemoteNode) {
+	p := pred
+	for i := 1; i < node.config.Replicas; i++ {
+		next, err := GetPredecessorId_RPC(p)
+		if err != nil || next == nil || next.Id == nil {
+			return
+		}
+		p = next
+		if EqualIds(p.Id, node.Id) {
+			// ring is smaller than the replication factor, we back up everyone
+			return
+		}
+	}
+
+	node.dsLock.Lock()
+	for k := range node.replicaStore {
+		if !BetweenRightIncl(HashKey(k), p.Id, pred.Id) {
+			delete(node.replicaStore, k)
+		}
+	}
+	node.dsLock.Unlock()
+}
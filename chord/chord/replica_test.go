@@ -0,0 +1,163 @@
+package chord
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMerkleTreeFindsDifferingBucket(t *testing.T) {
+	now := time.Now()
+	ours := map[string]dataEntry{"a": newDataEntry("1", 0), "b": newDataEntry("2", 0), "c": newDataEntry("3", 0)}
+	theirs := map[string]dataEntry{"a": newDataEntry("1", 0), "b": newDataEntry("2", 0), "c": newDataEntry("3", 0)}
+	all := []byte{0}
+
+	a := newMerkleTree(ours, all, all, now)
+	b := newMerkleTree(theirs, all, all, now)
+	if !bytes.Equal(a.levels[0][0], b.levels[0][0]) {
+		t.Fatalf("equal stores have different roots")
+	}
+
+	theirs["b"] = newDataEntry("stale", 0)
+	b = newMerkleTree(theirs, all, all, now)
+	if bytes.Equal(a.levels[0][0], b.levels[0][0]) {
+		t.Fatalf("differing stores have equal roots")
+	}
+	leaf := merkleBucket("b", a.depth)
+	for i := range a.levels[a.depth] {
+		same := bytes.Equal(a.levels[a.depth][i], b.levels[b.depth][i])
+		if same == (i == leaf) {
+			t.Errorf("leaf %v: equal=%v, only leaf %v should differ", i, same, leaf)
+		}
+	}
+}
+
+func TestRepairReplicaTakesOnlyNewerVersions(t *testing.T) {
+	node := newTestRing(t, 50)[0]
+	node.replicaStore["newer"] = dataEntry{Value: "mine", Version: 20}
+	node.replicaStore["older"] = dataEntry{Value: "mine", Version: 5}
+	node.replicaStore["kept"] = dataEntry{Value: "mine", Version: 20}
+	node.replicaStore["dropped"] = dataEntry{Value: "mine", Version: 5}
+	node.replicaStore["legacy"] = dataEntry{Value: "mine", Version: 20}
+	all := []byte{0}
+
+	req := RepairReq{node.Id, all, all,
+		[]KeyValue{{"newer", "theirs", 0}, {"older", "theirs", 0}}, []int64{10, 10},
+		[]string{"kept", "dropped", "legacy"}, []int64{10, 10}}
+	var reply RpcOkay
+	if err := node.RepairReplica_Handler(&req, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if v := node.replicaStore["newer"]; v.Value != "mine" {
+		t.Errorf("repair overwrote version 20 with 10")
+	}
+	if v := node.replicaStore["older"]; v.Value != "theirs" || v.Version != 10 {
+		t.Errorf("repair did not replace version 5: %+v", v)
+	}
+	if _, ok := node.replicaStore["kept"]; !ok {
+		t.Errorf("repair deleted version 20 at 10")
+	}
+	if _, ok := node.replicaStore["dropped"]; ok {
+		t.Errorf("repair kept version 5 deleted at 10")
+	}
+	// senders without DeleteVersions delete unconditionally, as before
+	if _, ok := node.replicaStore["legacy"]; ok {
+		t.Errorf("delete without a version kept the key")
+	}
+}
+
+func TestQuorumDeleteLeavesTombstones(t *testing.T) {
+	nodes := newTestRing(t, 10, 90, 170)
+	client := NewClient(nodes[0].RemoteSelf)
+	for _, node := range nodes {
+		node.config.Replicas = 3
+		client.learn(node.RemoteSelf)
+		client.cacheRange(node.RemoteSelf)
+	}
+	if err := client.PutWithConsistency("k", "v", 0, CONSISTENCY_ALL); err != nil {
+		t.Fatal(err)
+	}
+	owner, err := client.Lookup("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stale *Node
+	for _, node := range nodes {
+		if !EqualIds(node.Id, owner.Id) {
+			stale = node
+		}
+	}
+	old := stale.replicaStore["k"]
+
+	if err := client.DeleteWithConsistency("k", CONSISTENCY_ALL); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		entry, ok := node.dataStore["k"]
+		if !ok {
+			entry, ok = node.replicaStore["k"]
+		}
+		if !ok || !entry.Deleted || entry.Version <= old.Version || entry.ttl(time.Now()) > TOMBSTONE_TTL {
+			t.Errorf("node %v holds %+v after the delete, want a tombstone", HashStr(node.Id), entry)
+		}
+	}
+
+	// a replica that missed the delete loses against the tombstone and is repaired
+	stale.dsLock.Lock()
+	stale.replicaStore["k"] = old
+	stale.dsLock.Unlock()
+	if _, err := client.GetWithConsistency("k", CONSISTENCY_ALL); err == nil {
+		t.Errorf("deleted key read back")
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		stale.dsLock.RLock()
+		repaired := stale.replicaStore["k"].Deleted
+		stale.dsLock.RUnlock()
+		if repaired {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("read repair did not send the tombstone")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := client.Get("k"); err == nil {
+		t.Errorf("owner hands out a tombstone")
+	}
+}
+
+func TestConsistencyCountsUnreachableReplicas(t *testing.T) {
+	nodes := newTestRing(t, 10, 70, 130, 200)
+	for _, node := range nodes {
+		node.config.Replicas = 4
+	}
+	// 10 owns the key, 70 answers, 130 is gone and 200 is never found
+	nodes[2].Listener.Close()
+	key := keyIn(t, 200, 10, "")
+	client := NewClient(nodes[0].RemoteSelf)
+
+	if err := client.PutWithConsistency(key, "v", 0, CONSISTENCY_QUORUM); err == nil {
+		t.Errorf("quorum of 4 replicas reached with 2 of them")
+	}
+	if err := client.PutWithConsistency(key, "v", 0, CONSISTENCY_ONE); err != nil {
+		t.Errorf("write at one failed: %v", err)
+	}
+	if _, err := client.GetWithConsistency(key, CONSISTENCY_QUORUM); err == nil {
+		t.Errorf("quorum read of 4 replicas answered by 2 of them")
+	}
+}
+
+func TestConsistencyAllOnSmallRing(t *testing.T) {
+	nodes := newTestRing(t, 10, 90, 170)
+	for _, node := range nodes {
+		node.config.Replicas = 5
+	}
+	client := NewClient(nodes[0].RemoteSelf)
+	if err := client.PutWithConsistency("k", "v", 0, CONSISTENCY_ALL); err != nil {
+		t.Fatalf("write to every node of a ring smaller than Replicas: %v", err)
+	}
+	if value, err := client.GetWithConsistency("k", CONSISTENCY_ALL); err != nil || value != "v" {
+		t.Errorf("read at all = %q, %v", value, err)
+	}
+}
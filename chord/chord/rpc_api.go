@@ -8,7 +8,11 @@ package chord
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net/rpc"
+	"strings"
+	"sync"
+	"time"
 )
 
 type RemoteId struct {
@@ -34,11 +38,89 @@ type KeyValueReq struct {
 	NodeId []byte
 	Key    string
 	Value  string
+	TTL    time.Duration /* Time left to live, 0 for keys that never expire */
 }
 
 type KeyValueReply struct {
+	Key          string
+	Value        string
+	TTL          time.Duration /* Time left to live, 0 for keys that never expire */
+	Version      int64         /* Version of Value, 0 when a replica does not have the key */
+	Deleted      bool          /* Version is a delete, Value is empty */
+	RedirectId   []byte        /* Set when the key is not the node's, its guess of the owner */
+	RedirectAddr string
+}
+
+/* A request reached a node that does not own the key */
+type WrongOwnerError struct {
 	Key   string
-	Value string
+	Node  *RemoteNode /* Node that rejected the key */
+	Owner *RemoteNode /* Who that node believes owns the key, may be nil */
+}
+
+func (e *WrongOwnerError) Error() string {
+	if e.Owner == nil {
+		return fmt.Sprintf("Key %v is not owned by node %v", e.Key, HashStr(e.Node.Id))
+	}
+	return fmt.Sprintf("Key %v is not owned by node %v, try node %v at %v",
+		e.Key, HashStr(e.Node.Id), HashStr(e.Owner.Id), e.Owner.Addr)
+}
+
+/* WrongOwnerError out of a reply carrying a redirect, nil otherwise */
+func redirectError(locNode *RemoteNode, key string, reply *KeyValueReply) error {
+	if reply.RedirectId == nil {
+		return nil
+	}
+	return &WrongOwnerError{key, locNode, &RemoteNode{reply.RedirectId, reply.RedirectAddr}}
+}
+
+type KeyValueBatchReq struct {
+	NodeId []byte
+	Reqs   []KeyValueReq
+}
+
+type KeyValueBatchReply struct {
+	Replies []KeyValueReply
+	Errors  []string /* Per key, "" on success */
+}
+
+type WatchReq struct {
+	NodeId []byte
+	SubId  string /* Chosen by the watcher, the same on every node holding the subscription */
+	Key    string /* Key, or key prefix when Prefix is set */
+	Prefix bool
+}
+
+type WatchReply struct {
+	RedirectId   []byte /* Set when a key watch reached a node not owning the key */
+	RedirectAddr string
+}
+
+type PollWatchReq struct {
+	NodeId []byte
+	SubId  string
+	After  uint64        /* Only events with a higher Seq are returned */
+	Wait   time.Duration /* How long to wait for an event before replying empty */
+}
+
+type PollWatchReply struct {
+	Events  []WatchEvent
+	MovedTo *RemoteNode   /* Subscription left this node for MovedTo, poll there from now on */
+	AlsoOn  []*RemoteNode /* Prefix subscription was copied to these nodes as well */
+	Unknown bool          /* Node has no such subscription (expired or never registered) */
+}
+
+type NotifyReq struct {
+	NodeId     []byte /* Node being notified */
+	UpdateId   []byte /* Node that believes it is NodeId's predecessor */
+	UpdateAddr string
+}
+
+type UpdateReq struct {
+	FromId     []byte /* Node being updated */
+	SenderId   []byte /* Neighbour of FromId giving up its place */
+	UpdateId   []byte /* FromId's new neighbour, nil for none */
+	UpdateAddr string
 }
 
 type TransferReq struct {
@@ -48,8 +130,82 @@ type TransferReq struct {
 	PredId   []byte
 }
 
+type HandOffReq struct {
+	NodeId   []byte     /* New owner of the keys */
+	FromId   []byte     /* Node handing them over */
+	Entries  []KeyValue /* TTLs as time left */
+	Versions []int64    /* Version of each of Entries */
+	Deleted  []bool     /* Which of Entries are tombstones, nil when none are */
+}
+
+type FingerTableReply struct {
+	Fingers []FingerEntry
+}
+
+type KeysReply struct {
+	Keys []string
+}
+
+type MerkleReq struct {
+	NodeId  []byte
+	From    []byte /* Range (From, To] the tree is built over */
+	To      []byte
+	Level   int
+	Indexes []int /* Tree nodes at Level, or leaf buckets for BucketDigests */
+}
+
+type MerkleReply struct {
+	Hashes  [][]byte          /* One per requested index */
+	Digests map[string][]byte /* Value digest of every key in the requested buckets */
+}
+
+type RepairReq struct {
+	NodeId         []byte
+	From           []byte
+	To             []byte
+	Puts           []KeyValue
+	Versions       []int64 /* Version of each of Puts */
+	Deletes        []string
+	DeleteVersions []int64 /* Version each of Deletes removes, newer copies are kept. Absent removes any */
+}
+
+type VersionedReq struct {
+	NodeId  []byte
+	Key     string
+	Value   string
+	TTL     time.Duration
+	Version int64
+	Deleted bool /* Write a tombstone at Version instead of Value */
+}
+
+type ReplicaSetReply struct {
+	Replicas     []*RemoteNode /* Owner first, then the successors holding copies */
+	Wanted       int           /* Replicas the key should have, more than len(Replicas) if some are unreachable */
+	RedirectId   []byte
+	RedirectAddr string
+}
+
+type RangeReply struct {
+	PredId  []byte     /* Start of the range (exclusive), nil if the node has no predecessor */
+	Entries []KeyValue /* Keys in (PredId, node id], TTLs as time left */
+	Strays  int        /* Keys held outside the range, not yet handed to their owner */
+}
+
+type HelloReq struct {
+	Version      int      /* Newest protocol version the caller speaks */
+	MinVersion   int      /* Oldest one it still talks to */
+	Capabilities []string /* Unknown names are ignored */
+}
+
+type HelloReply struct {
+	Version      int
+	MinVersion   int
+	Capabilities []string
+}
+
 /* RPC connection map cache */
 var connMap = make(map[string]*rpc.Client)
+var connLock sync.Mutex
 
 
 ////////////////////////////////////////////////////////////////////////////////////////
@@ -72,8 +228,11 @@ func Get_RPC(locNode *RemoteNode, key string) (string, error) {
 	}
 
 	var reply KeyValueReply
-	req := KeyValueReq{locNode.Id, key, ""}
+	req := KeyValueReq{locNode.Id, key, "", 0}
 	err := makeRemoteCall(locNode, "GetLocal_Handler", &req, &reply)
+	if err == nil {
+		err = redirectError(locNode, key, &reply)
+	}
 
 	return reply.Value, err
 }
@@ -82,13 +241,139 @@ func Get_RPC(locNode *RemoteNode, key string) (string, error) {
 
 /* Put a key/value into a datastore on a remote node */
 func Put_RPC(locNode *RemoteNode, key string, value string) error {
+	return PutTTL_RPC(locNode, key, value, 0)
+}
+
+
+
+/* Put a key/value that expires after ttl into a datastore on a remote node, 0 never expires */
+func PutTTL_RPC(locNode *RemoteNode, key string, value string, ttl time.Duration) error {
 	if locNode == nil {
 		return errors.New("RemoteNode is empty!")
 	}
 
 	var reply KeyValueReply
-	req := KeyValueReq{locNode.Id, key, value}
+	req := KeyValueReq{locNode.Id, key, value, ttl}
 	err := makeRemoteCall(locNode, "PutLocal_Handler", &req, &reply)
+	if err == nil {
+		err = redirectError(locNode, key, &reply)
+	}
+
+	return err
+}
+
+
+/* Get values for many keys from a remote node's datastore, with one result per key */
+func GetMany_RPC(locNode *RemoteNode, keys []string) ([]KeyResult, error) {
+	if locNode == nil {
+		return nil, errors.New("RemoteNode is empty!")
+	}
+	req := KeyValueBatchReq{NodeId: locNode.Id}
+	for _, key := range keys {
+		req.Reqs = append(req.Reqs, KeyValueReq{locNode.Id, key, "", 0})
+	}
+	return batchRemoteCall(locNode, "GetLocalMany_Handler", &req)
+}
+
+
+
+/* Put many key/values into a datastore on a remote node, with one result per key */
+func PutMany_RPC(locNode *RemoteNode, pairs []KeyValue) ([]KeyResult, error) {
+	if locNode == nil {
+		return nil, errors.New("RemoteNode is empty!")
+	}
+	req := KeyValueBatchReq{NodeId: locNode.Id}
+	for _, pair := range pairs {
+		req.Reqs = append(req.Reqs, KeyValueReq{locNode.Id, pair.Key, pair.Value, pair.TTL})
+	}
+	return batchRemoteCall(locNode, "PutLocalMany_Handler", &req)
+}
+
+
+
+/* Send a batch and turn the reply back into per key results, redirects become WrongOwnerErrors */
+func batchRemoteCall(locNode *RemoteNode, method string, req *KeyValueBatchReq) ([]KeyResult, error) {
+	var reply KeyValueBatchReply
+	err := makeRemoteCall(locNode, method, req, &reply)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.Replies) != len(req.Reqs) || len(reply.Errors) != len(req.Reqs) {
+		return nil, errors.New(fmt.Sprintf("RPC replied %v results for %v keys from %v",
+			len(reply.Replies), len(req.Reqs), locNode.Id))
+	}
+
+	results := make([]KeyResult, len(req.Reqs))
+	for i := range req.Reqs {
+		results[i].Key = req.Reqs[i].Key
+		results[i].Value = reply.Replies[i].Value
+		if reply.Errors[i] != "" {
+			results[i].Err = rpc.ServerError(reply.Errors[i])
+		} else {
+			results[i].Err = redirectError(locNode, req.Reqs[i].Key, &reply.Replies[i])
+		}
+	}
+	return results, nil
+}
+
+
+
+/* Register a key or prefix watch on a remote node, redirects become WrongOwnerErrors */
+func Watch_RPC(remoteNode *RemoteNode, subId string, key string, prefix bool) error {
+	if remoteNode == nil {
+		return errors.New("RemoteNode is empty!")
+	}
+	var reply WatchReply
+	req := WatchReq{remoteNode.Id, subId, key, prefix}
+	err := makeRemoteCall(remoteNode, "Watch_Handler", &req, &reply)
+	if err == nil && reply.RedirectId != nil {
+		err = &WrongOwnerError{key, remoteNode, &RemoteNode{reply.RedirectId, reply.RedirectAddr}}
+	}
+	return err
+}
+
+
+
+/* Wait up to wait for events of a watch on a remote node */
+func PollWatch_RPC(remoteNode *RemoteNode, subId string, after uint64, wait time.Duration) (*PollWatchReply, error) {
+	if remoteNode == nil {
+		return nil, errors.New("RemoteNode is empty!")
+	}
+	var reply PollWatchReply
+	req := PollWatchReq{remoteNode.Id, subId, after, wait}
+	err := makeRemoteCall(remoteNode, "PollWatch_Handler", &req, &reply)
+	if err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+
+
+/* Remove a watch from a remote node */
+func Unwatch_RPC(remoteNode *RemoteNode, subId string) error {
+	if remoteNode == nil {
+		return errors.New("RemoteNode is empty!")
+	}
+	var reply RpcOkay
+	req := PollWatchReq{NodeId: remoteNode.Id, SubId: subId}
+	return makeRemoteCall(remoteNode, "Unwatch_Handler", &req, &reply)
+}
+
+
+
+/* Delete a key from a datastore on a remote node */
+func Delete_RPC(locNode *RemoteNode, key string) error {
+	if locNode == nil {
+		return errors.New("RemoteNode is empty!")
+	}
+
+	var reply KeyValueReply
+	req := KeyValueReq{locNode.Id, key, "", 0}
+	err := makeRemoteCall(locNode, "DeleteLocal_Handler", &req, &reply)
+	if err == nil {
+		err = redirectError(locNode, key, &reply)
+	}
 
 	return err
 }
@@ -163,6 +448,17 @@ func ClosestPrecedingFinger_RPC(remoteNode *RemoteNode, id []byte) (*RemoteNode,
 
 
 
+/* Round trip to a remote node and back, nothing else */
+func Ping_RPC(remoteNode *RemoteNode) error {
+	if remoteNode == nil {
+		return errors.New("RemoteNode is empty!")
+	}
+	var reply RpcOkay
+	return makeRemoteCall(remoteNode, "Ping_Handler", RemoteId{remoteNode.Id}, &reply)
+}
+
+
+
 /* 
 recursively hop finger tables find the successor node of a given ID 
 TEST: highest successor node in finger table that is smaller than new node id 
@@ -186,13 +482,171 @@ func FindSuccessor_RPC(remoteNode *RemoteNode, id []byte) (*RemoteNode, error) {
 
 
 
+/* Get a copy of a remote node's finger table */
+func GetFingerTable_RPC(remoteNode *RemoteNode) ([]FingerEntry, error) {
+	if remoteNode == nil {
+		return nil, errors.New("RemoteNode is empty!")
+	}
+	var reply FingerTableReply
+	err := makeRemoteCall(remoteNode, "GetFingerTable_Handler", RemoteId{remoteNode.Id}, &reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Fingers, nil
+}
+
+
+
+/* Get the keys currently held in a remote node's datastore */
+func GetKeys_RPC(remoteNode *RemoteNode) ([]string, error) {
+	if remoteNode == nil {
+		return nil, errors.New("RemoteNode is empty!")
+	}
+	var reply KeysReply
+	err := makeRemoteCall(remoteNode, "GetKeys_Handler", RemoteId{remoteNode.Id}, &reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Keys, nil
+}
+
+
+
+/* Get the keys a remote node owns, with values and TTLs, and where its range starts */
+func GetRange_RPC(remoteNode *RemoteNode) (*RangeReply, error) {
+	if remoteNode == nil {
+		return nil, errors.New("RemoteNode is empty!")
+	}
+	var reply RangeReply
+	err := makeRemoteCall(remoteNode, "GetRange_Handler", RemoteId{remoteNode.Id}, &reply)
+	if err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+
+
+/* Hashes of some nodes of a remote node's Merkle tree over its replicas in (from, to] */
+func MerkleHashes_RPC(remoteNode *RemoteNode, from []byte, to []byte, level int, indexes []int) ([][]byte, error) {
+	if remoteNode == nil {
+		return nil, errors.New("RemoteNode is empty!")
+	}
+	var reply MerkleReply
+	req := MerkleReq{remoteNode.Id, from, to, level, indexes}
+	if err := makeRemoteCall(remoteNode, "MerkleHashes_Handler", req, &reply); err != nil {
+		return nil, err
+	}
+	if len(reply.Hashes) != len(indexes) {
+		return nil, errors.New(fmt.Sprintf("asked for %v hashes, got %v", len(indexes), len(reply.Hashes)))
+	}
+	return reply.Hashes, nil
+}
+
+
+
+/* Value digests of a remote node's replicas in (from, to] that fall in the given leaf buckets */
+func BucketDigests_RPC(remoteNode *RemoteNode, from []byte, to []byte, buckets []int) (map[string][]byte, error) {
+	if remoteNode == nil {
+		return nil, errors.New("RemoteNode is empty!")
+	}
+	var reply MerkleReply
+	req := MerkleReq{remoteNode.Id, from, to, merkleDepth(), buckets}
+	if err := makeRemoteCall(remoteNode, "BucketDigests_Handler", req, &reply); err != nil {
+		return nil, err
+	}
+	if reply.Digests == nil {
+		reply.Digests = make(map[string][]byte)
+	}
+	return reply.Digests, nil
+}
+
+
+
+/* Overwrite and delete replicas on a remote node, keys outside (from, to] are refused */
+func RepairReplica_RPC(remoteNode *RemoteNode, from []byte, to []byte, puts []KeyValue, versions []int64,
+	deletes []string, deleteVersions []int64) error {
+	if remoteNode == nil {
+		return errors.New("RemoteNode is empty!")
+	}
+	var reply RpcOkay
+	req := RepairReq{remoteNode.Id, from, to, puts, versions, deletes, deleteVersions}
+	return makeRemoteCall(remoteNode, "RepairReplica_Handler", req, &reply)
+}
+
+
+
+/* The nodes holding copies of key and how many there should be, asked from its owner */
+func ReplicaSet_RPC(locNode *RemoteNode, key string) ([]*RemoteNode, int, error) {
+	if locNode == nil {
+		return nil, 0, errors.New("RemoteNode is empty!")
+	}
+	var reply ReplicaSetReply
+	req := KeyValueReq{locNode.Id, key, "", 0}
+	if err := makeRemoteCall(locNode, "ReplicaSet_Handler", &req, &reply); err != nil {
+		return nil, 0, err
+	}
+	if reply.RedirectId != nil {
+		return nil, 0, &WrongOwnerError{key, locNode, &RemoteNode{reply.RedirectId, reply.RedirectAddr}}
+	}
+	if len(reply.Replicas) == 0 {
+		return nil, 0, errors.New("no replicas returned")
+	}
+	if reply.Wanted < len(reply.Replicas) {
+		// owners from before Wanted existed
+		reply.Wanted = len(reply.Replicas)
+	}
+	return reply.Replicas, reply.Wanted, nil
+}
+
+
+
+/* Get key with its version from a remote node, owner or replica. Version 0 means not there */
+func GetVersioned_RPC(remoteNode *RemoteNode, key string) (*KeyValueReply, error) {
+	if remoteNode == nil {
+		return nil, errors.New("RemoteNode is empty!")
+	}
+	var reply KeyValueReply
+	req := VersionedReq{NodeId: remoteNode.Id, Key: key}
+	if err := makeRemoteCall(remoteNode, "GetVersioned_Handler", &req, &reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+
+
+/* Write key at version to a remote node, owner or replica, unless it has a newer one */
+func PutVersioned_RPC(remoteNode *RemoteNode, key string, value string, ttl time.Duration, version int64) error {
+	if remoteNode == nil {
+		return errors.New("RemoteNode is empty!")
+	}
+	var reply KeyValueReply
+	req := VersionedReq{remoteNode.Id, key, value, ttl, version, false}
+	return makeRemoteCall(remoteNode, "PutVersioned_Handler", &req, &reply)
+}
+
+
+/* Delete key at version on a remote node, owner or replica, unless it has a newer one */
+func DeleteVersioned_RPC(remoteNode *RemoteNode, key string, version int64) error {
+	if remoteNode == nil {
+		return errors.New("RemoteNode is empty!")
+	}
+	var reply KeyValueReply
+	req := VersionedReq{NodeId: remoteNode.Id, Key: key, Version: version, Deleted: true}
+	return makeRemoteCall(remoteNode, "PutVersioned_Handler", &req, &reply)
+}
+
+
+
 /* Notify a remote node that we believe we are its predecessor */
 func Notify_RPC(remoteNode, us *RemoteNode) error {
 	if remoteNode == nil {
 		return errors.New("RemoteNode is empty!")
 	}
 	var reply RpcOkay
-	err := makeRemoteCall(remoteNode, "Notify_Handler", us, &reply)
+	req := NotifyReq{remoteNode.Id, us.Id, us.Addr}
+	err := makeRemoteCall(remoteNode, "Notify_Handler", &req, &reply)
 	if !reply.Ok {
 		return errors.New(fmt.Sprintf("RPC replied not valid from %v", remoteNode.Id))
 	}
@@ -202,6 +656,59 @@ func Notify_RPC(remoteNode, us *RemoteNode) error {
 
 
 
+/*
+Hand keys over to their new owner with their versions, it takes them without checking its range
+
+deleted marks the tombstones among entries, nil if there are none.
+*/
+func HandOffKeys_RPC(remoteNode *RemoteNode, from *RemoteNode, entries []KeyValue, versions []int64, deleted []bool) error {
+	if remoteNode == nil {
+		return errors.New("RemoteNode is empty!")
+	}
+	var reply RpcOkay
+	req := HandOffReq{remoteNode.Id, from.Id, entries, versions, deleted}
+	err := makeRemoteCall(remoteNode, "HandOffKeys_Handler", &req, &reply)
+	if err == nil && !reply.Ok {
+		err = errors.New(fmt.Sprintf("RPC replied not valid from %v", remoteNode.Id))
+	}
+	return err
+}
+
+
+
+/* Tell our successor that its predecessor is now pred (may be nil), as we are leaving */
+func SetPredecessorId_RPC(remoteNode *RemoteNode, us *RemoteNode, pred *RemoteNode) error {
+	return updateNeighbour(remoteNode, "SetPredecessorId", us, pred)
+}
+
+
+
+/* Tell our predecessor that its successor is now succ, as we are leaving */
+func SetSuccessorId_RPC(remoteNode *RemoteNode, us *RemoteNode, succ *RemoteNode) error {
+	return updateNeighbour(remoteNode, "SetSuccessorId", us, succ)
+}
+
+
+
+func updateNeighbour(remoteNode *RemoteNode, method string, us *RemoteNode, update *RemoteNode) error {
+	if remoteNode == nil {
+		return errors.New("RemoteNode is empty!")
+	}
+	var reply RpcOkay
+	req := UpdateReq{FromId: remoteNode.Id, SenderId: us.Id}
+	if update != nil {
+		req.UpdateId = update.Id
+		req.UpdateAddr = update.Addr
+	}
+	err := makeRemoteCall(remoteNode, method, &req, &reply)
+	if err == nil && !reply.Ok {
+		err = errors.New(fmt.Sprintf("RPC replied not valid from %v", remoteNode.Id))
+	}
+	return err
+}
+
+
+
 /* Inform a successor node that we should now take care of IDs between (node.Id : predId] */
 /* This should trigger the successor node to transfer the relevant keys back to node      */
 func TransferKeys_RPC(succ *RemoteNode, node *RemoteNode, predId []byte) error {
@@ -217,8 +724,8 @@ func TransferKeys_RPC(succ *RemoteNode, node *RemoteNode, predId []byte) error {
 	req.PredId = predId // where to send data to (predecessor)
 
 	err := makeRemoteCall(succ, "TransferKeys_Handler", &req, &reply)
-	if !reply.Ok {
-		fmt.Println(err)
+	if err == nil && !reply.Ok {
+		err = errors.New(fmt.Sprintf("RPC replied not valid from %v", succ.Id))
 	}
 
 	return err
@@ -234,26 +741,115 @@ func TransferKeys_RPC(succ *RemoteNode, node *RemoteNode, predId []byte) error {
 ////////////////////////////////////////////////////////////////////////////////////////
 ////////////////////////////////////////////////////////////////////////////////////////
 
-/* Helper function to make a call to a remote node */
+/*
+Helper function to make a call to a remote node, backing off while it is overloaded
+
+the retries sleep for up to OVERLOAD_RETRIES backoffs. A cached connection
+found closed before the request went out is redialled and the call tried
+again at once. Never call this, or any *_RPC, while holding dsLock, ftLock,
+watchLock or another node lock: every request to us waiting on that lock
+would wait out the backoff too. Copy what the call needs under the lock and
+call after releasing it.
+*/
 func makeRemoteCall(remoteNode *RemoteNode, method string, req interface{}, rsp interface{}) error {
-	// Dial the server if we don't already have a connection to it
-	remoteNodeAddrStr := remoteNode.Addr
-	var err error
-	client, ok := connMap[remoteNodeAddrStr]
-	if !ok {
-		client, err = rpc.Dial("tcp", remoteNode.Addr)
-		if err != nil {
+	redialled := false
+	for attempt := 0; ; {
+		err := remoteCall(remoteNode, method, req, rsp)
+		if err == rpc.ErrShutdown && !redialled {
+			redialled = true
+			continue
+		}
+		if !IsOverloadedError(err) || attempt == OVERLOAD_RETRIES {
 			return err
 		}
-		connMap[remoteNodeAddrStr] = client
+		time.Sleep(overloadBackoff(attempt))
+		attempt++
+	}
+}
+
+/* One try of makeRemoteCall */
+func remoteCall(remoteNode *RemoteNode, method string, req interface{}, rsp interface{}) error {
+	// Dial the server if we don't already have a connection to it
+	remoteNodeAddrStr := remoteNode.Addr
+	client, err := cachedClient(remoteNode)
+	if err != nil {
+		rpcClientErrorsTotal.inc(remoteNodeAddrStr, method)
+		return err
+	}
+	if err := checkCapabilities(remoteNodeAddrStr, method, req); err != nil {
+		rpcClientErrorsTotal.inc(remoteNodeAddrStr, method)
+		return err
 	}
 
 	// Make the request
 	uniqueMethodName := fmt.Sprintf("%v.%v", remoteNodeAddrStr, method)
 	err = client.Call(uniqueMethodName, req, rsp)
 	if err != nil {
+		rpcClientErrorsTotal.inc(remoteNodeAddrStr, method)
+		if deadConnError(err) {
+			dropCachedClient(remoteNodeAddrStr, client)
+		}
 		return err
 	}
 
 	return nil
 }
+
+/*
+Did err leave the connection it came on useless? Closed connections fail
+every later call, and one over the remote's MaxConns has every request on
+it refused until the remote hangs up
+*/
+func deadConnError(err error) bool {
+	return err == rpc.ErrShutdown || err == io.ErrUnexpectedEOF ||
+		strings.HasPrefix(err.Error(), ERR_TOO_MANY_CONNS)
+}
+
+/*
+Client for remoteNode out of connMap, dialled if there is none
+
+connLock only guards the map, it is never held while dialling: one slow peer
+must not hold up calls to every other. Of two concurrent dials to the same
+node the first one in the map is kept.
+*/
+func cachedClient(remoteNode *RemoteNode) (*rpc.Client, error) {
+	connLock.Lock()
+	client, ok := connMap[remoteNode.Addr]
+	connLock.Unlock()
+	if ok {
+		return client, nil
+	}
+
+	client, err := dialRemote(remoteNode)
+	if err != nil {
+		return nil, err
+	}
+	connLock.Lock()
+	defer connLock.Unlock()
+	if existing, ok := connMap[remoteNode.Addr]; ok {
+		client.Close()
+		return existing, nil
+	}
+	connMap[remoteNode.Addr] = client
+	return client, nil
+}
+
+/* Close client and take it out of connMap, unless it was replaced there already */
+func dropCachedClient(addr string, client *rpc.Client) {
+	connLock.Lock()
+	if connMap[addr] == client {
+		delete(connMap, addr)
+	}
+	connLock.Unlock()
+	client.Close()
+}
+
+/* Close every cached client, the next call to a node dials it again */
+func dropCachedClients() {
+	connLock.Lock()
+	defer connLock.Unlock()
+	for addr, client := range connMap {
+		client.Close()
+		delete(connMap, addr)
+	}
+}
@@ -0,0 +1,155 @@
+/*                                                                           */
+/*  Purpose: Whole-ring topology snapshots, exported as JSON or as a         */
+/*           Graphviz DOT ring diagram.                                      */
+/*                                                                           */
+
+package chord
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+/* Reference to another node inside a snapshot */
+type NodeRef struct {
+	Id   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+/* A single finger table entry inside a snapshot */
+type FingerSnapshot struct {
+	Index int      `json:"index"`
+	Start string   `json:"start"`
+	Node  *NodeRef `json:"node"`
+}
+
+/* Everything we could learn about one node */
+type NodeSnapshot struct {
+	Id          string           `json:"id"`
+	Addr        string           `json:"addr"`
+	Successor   *NodeRef         `json:"successor"`
+	Predecessor *NodeRef         `json:"predecessor"`
+	Fingers     []FingerSnapshot `json:"fingers"`
+	KeyCount    int              `json:"key_count"`
+	Errors      []string         `json:"errors,omitempty"`
+}
+
+/* Snapshot of a whole ring, nodes in successor order */
+type RingSnapshot struct {
+	Taken     time.Time      `json:"taken"`
+	KeyLength int            `json:"key_length"`
+	Nodes     []NodeSnapshot `json:"nodes"`
+	Errors    []string       `json:"errors,omitempty"`
+}
+
+func newNodeRef(remoteNode *RemoteNode) *NodeRef {
+	if remoteNode == nil || remoteNode.Id == nil {
+		return nil
+	}
+	return &NodeRef{HashStr(remoteNode.Id), remoteNode.Addr}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+
+/*
+Walk the ring from start and collect every node's pointers, fingers and key count
+
+a node that fails to answer some RPC is still included, with the failures
+listed in its Errors. Problems with the successor chain itself end up in
+the snapshot's Errors.
+*/
+func SnapshotRing(start *RemoteNode) (*RingSnapshot, error) {
+	walk := new(RingReport)
+	nodes, err := walkRing(start, walk)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := new(RingSnapshot)
+	snap.Taken = time.Now()
+	snap.KeyLength = KEY_LENGTH
+	for _, v := range walk.Violations {
+		snap.Errors = append(snap.Errors, fmt.Sprintf("%v: %v", HashStr(v.Node.Id), v.Detail))
+	}
+
+	for _, n := range nodes {
+		ns := NodeSnapshot{Id: HashStr(n.Id), Addr: n.Addr}
+
+		if succ, err := GetSuccessorId_RPC(n); err != nil {
+			ns.Errors = append(ns.Errors, err.Error())
+		} else {
+			ns.Successor = newNodeRef(succ)
+		}
+		if pred, err := GetPredecessorId_RPC(n); err != nil {
+			ns.Errors = append(ns.Errors, err.Error())
+		} else {
+			ns.Predecessor = newNodeRef(pred)
+		}
+		if fingers, err := GetFingerTable_RPC(n); err != nil {
+			ns.Errors = append(ns.Errors, err.Error())
+		} else {
+			for i, finger := range fingers {
+				fs := FingerSnapshot{Index: i, Node: newNodeRef(finger.Node)}
+				if finger.Start != nil {
+					fs.Start = HashStr(finger.Start)
+				}
+				ns.Fingers = append(ns.Fingers, fs)
+			}
+		}
+		if keys, err := GetKeys_RPC(n); err != nil {
+			ns.Errors = append(ns.Errors, err.Error())
+		} else {
+			ns.KeyCount = len(keys)
+		}
+
+		snap.Nodes = append(snap.Nodes, ns)
+	}
+	return snap, nil
+}
+
+/* Indented JSON encoding of the snapshot */
+func (snap *RingSnapshot) JSON() ([]byte, error) {
+	return json.MarshalIndent(snap, "", "  ")
+}
+
+/*
+Graphviz DOT ring diagram of the snapshot
+
+solid edges are successors, dashed edges predecessors and dotted grey edges
+fingers (one edge per distinct finger target). Render with `circo`.
+*/
+func (snap *RingSnapshot) DOT() string {
+	var buf bytes.Buffer
+	buf.WriteString("digraph chord {\n")
+	buf.WriteString("\tlayout=circo;\n")
+	buf.WriteString("\tnode [shape=circle];\n")
+	for _, n := range snap.Nodes {
+		fmt.Fprintf(&buf, "\t\"%v\" [label=\"%v\\n%v\\n%v keys\"];\n", n.Id, n.Id, n.Addr, n.KeyCount)
+	}
+	for _, n := range snap.Nodes {
+		if n.Successor != nil {
+			fmt.Fprintf(&buf, "\t\"%v\" -> \"%v\" [label=\"succ\"];\n", n.Id, n.Successor.Id)
+		}
+		if n.Predecessor != nil {
+			fmt.Fprintf(&buf, "\t\"%v\" -> \"%v\" [style=dashed, label=\"pred\"];\n", n.Id, n.Predecessor.Id)
+		}
+		drawn := make(map[string]bool)
+		for _, f := range n.Fingers {
+			if f.Node == nil || f.Node.Id == n.Id || drawn[f.Node.Id] {
+				continue
+			}
+			if n.Successor != nil && f.Node.Id == n.Successor.Id {
+				continue
+			}
+			drawn[f.Node.Id] = true
+			fmt.Fprintf(&buf, "\t\"%v\" -> \"%v\" [style=dotted, color=grey];\n", n.Id, f.Node.Id)
+		}
+	}
+	buf.WriteString("}\n")
+	return buf.String()
+}
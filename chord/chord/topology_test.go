@@ -0,0 +1,51 @@
+package chord
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotRing(t *testing.T) {
+	nodes := newTestRing(t, 20, 90, 180)
+	putOnOwners(nodes, "a", "b", "c", "d", "e", "f")
+
+	snap, err := SnapshotRing(nodes[0].RemoteSelf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.Nodes) != 3 || len(snap.Errors) != 0 {
+		t.Fatalf("snapshot has %v nodes and errors %v", len(snap.Nodes), snap.Errors)
+	}
+	keys := 0
+	for i, ns := range snap.Nodes {
+		next := snap.Nodes[(i+1)%len(snap.Nodes)]
+		if ns.Successor == nil || ns.Successor.Id != next.Id || next.Predecessor == nil || next.Predecessor.Id != ns.Id {
+			t.Errorf("node %v: successor %v, %v has predecessor %v", ns.Id, ns.Successor, next.Id, next.Predecessor)
+		}
+		if len(ns.Fingers) != KEY_LENGTH {
+			t.Errorf("node %v has %v fingers", ns.Id, len(ns.Fingers))
+		}
+		keys += ns.KeyCount
+	}
+	if keys != 6 {
+		t.Errorf("snapshot counts %v keys, want 6", keys)
+	}
+
+	encoded, err := snap.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded RingSnapshot
+	if err := json.Unmarshal(encoded, &decoded); err != nil || len(decoded.Nodes) != 3 || decoded.Nodes[1].Addr != nodes[1].Addr {
+		t.Errorf("JSON did not round trip: %v", err)
+	}
+
+	dot := snap.DOT()
+	for _, ns := range snap.Nodes {
+		edge := "\"" + ns.Id + "\" -> \"" + ns.Successor.Id + "\" [label=\"succ\"]"
+		if !strings.Contains(dot, edge) {
+			t.Errorf("DOT has no successor edge %v:\n%v", edge, dot)
+		}
+	}
+}
@@ -0,0 +1,461 @@
+/*                                                                           */
+/*  Purpose: Optional mutual TLS between nodes. Node certificates carry the  */
+/*           node's ID, which peers check on every connection.               */
+/*                                                                           */
+
+package chord
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/rpc"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/* URI SAN scheme holding a node's ID in its certificate, e.g. chord:42 */
+const CERT_ID_SCHEME = "chord"
+
+/* How long a connecting peer gets to finish the TLS handshake */
+const TLS_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+/* How long dialling a node may take, TLS and version handshake included */
+var DIAL_TIMEOUT = 10 * time.Second
+
+/* PEM files of one TLS identity */
+type TLSConfig struct {
+	CertFile string /* Certificate, signed by the CA. A node's carries its ID */
+	KeyFile  string /* Private key of the certificate */
+	CAFile   string /* CA certificates every peer must be signed by */
+}
+
+/* Process-wide settings for outgoing connections, nil dials plain TCP */
+var clientTLS *tls.Config
+var clientTLSLock sync.RWMutex
+
+/*
+Make every outgoing RPC of this process use TLS with the given identity
+
+nodes created with Config.TLS call this themselves when nothing was set
+before. A Client outside of any node calls it to reach a TLS ring, its
+certificate may leave out the ID.
+*/
+func UseTLS(config *TLSConfig) error {
+	tlsConfig, _, err := loadTLS(config)
+	if err != nil {
+		return err
+	}
+	setClientTLS(tlsConfig, true)
+	return nil
+}
+
+func setClientTLS(tlsConfig *tls.Config, replace bool) {
+	clientTLSLock.Lock()
+	if clientTLS == nil || replace {
+		clientTLS = tlsConfig
+	}
+	clientTLSLock.Unlock()
+}
+
+/*
+load certificate, key and CA, returns the parsed certificate too
+
+both directions are verified against the CA only, hostnames are not
+checked: peers are identified by the ID in their certificate or the one
+derived from its public key.
+*/
+func loadTLS(config *TLSConfig) (*tls.Config, *x509.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := certId(leaf); err != nil {
+		return nil, nil, err
+	}
+	caPem, err := ioutil.ReadFile(config.CAFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPem) {
+		return nil, nil, errors.New(fmt.Sprintf("no certificates found in %v", config.CAFile))
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+		// the chain is verified in verifyPeer, against the node ID instead of a hostname
+		InsecureSkipVerify: true,
+	}
+	return tlsConfig, leaf, nil
+}
+
+/* ID in cert's chord: URI, nil when there is none */
+func certId(cert *x509.Certificate) ([]byte, error) {
+	for _, uri := range cert.URIs {
+		if uri.Scheme == CERT_ID_SCHEME {
+			return ParseId(uri.Opaque)
+		}
+	}
+	return nil, nil
+}
+
+/*
+Check a server's chain against roots and that it belongs to the node with
+the expected ID, named in the certificate or derived from its key
+
+a node dialled without an ID is refused: any certificate of the CA, one
+without an ID included, would pass for it.
+*/
+func verifyPeer(rawCerts [][]byte, roots *x509.CertPool, expected []byte, addr string) error {
+	if len(expected) == 0 {
+		return errors.New(fmt.Sprintf("no node ID to check the certificate of %v against", addr))
+	}
+	if len(rawCerts) == 0 {
+		return errors.New("peer sent no certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return err
+	}
+	id, err := certId(certs[0])
+	if err != nil {
+		return err
+	}
+	rememberPeerKey(addr, certs[0])
+	if !EqualIds(id, expected) && !EqualIds(PublicKeyId(certs[0]), expected) {
+		return errors.New(fmt.Sprintf("peer certificate is for node %v, expected %v", HashStr(id), HashStr(expected)))
+	}
+	return nil
+}
+
+/*
+Open an RPC client to remoteNode, over TLS when this process uses it, then
+do the version handshake
+
+requests are signed with the first of clientSecretCandidates the node
+accepts in the handshake, each try on a connection of its own. A node that
+accepts the connection but never answers fails a try after DIAL_TIMEOUT.
+*/
+func dialRemote(remoteNode *RemoteNode) (*rpc.Client, error) {
+	var client *rpc.Client
+	var err error
+	for _, secret := range clientSecretCandidates() {
+		client, err = dialWithSecret(remoteNode, secret)
+		// refused by the node, maybe for the secret, anything else is no better with another
+		if _, refused := err.(rpc.ServerError); !refused {
+			break
+		}
+	}
+	return client, err
+}
+
+/* One try of dialRemote, signing with secret unless it is nil */
+func dialWithSecret(remoteNode *RemoteNode, secret []byte) (*rpc.Client, error) {
+	clientTLSLock.RLock()
+	base := clientTLS
+	clientTLSLock.RUnlock()
+
+	deadline := time.Now().Add(DIAL_TIMEOUT)
+	dialer := &net.Dialer{Deadline: deadline}
+	var conn net.Conn
+	var err error
+	if base == nil {
+		conn, err = dialer.Dial("tcp", remoteNode.Addr)
+	} else {
+		tlsConfig := base.Clone()
+		expected := remoteNode.Id
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPeer(rawCerts, base.RootCAs, expected, remoteNode.Addr)
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", remoteNode.Addr, tlsConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	clientCodecLock.RLock()
+	wire := clientCodec
+	clientCodecLock.RUnlock()
+	codec := wire.newClientCodec(conn)
+	if secret != nil {
+		codec = &authClientCodec{codec, secret, wire}
+	}
+	conn.SetDeadline(deadline)
+	client := rpc.NewClientWithCodec(codec)
+	if err := handshake(client, remoteNode); err != nil {
+		client.Close()
+		return nil, err
+	}
+	// calls on the connection are not bounded, overload backs them off instead
+	conn.SetDeadline(time.Time{})
+	return client, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+
+/*
+Requests naming the node that sent them
+
+over TLS the name has to match the ID in the sender's certificate, so no
+one can notify, rewrite pointers or take keys from a node in another
+node's name.
+*/
+type senderClaim interface {
+	claimedSender() []byte
+}
+
+func (req *NotifyReq) claimedSender() []byte {
+	return req.UpdateId
+}
+
+func (req *TransferReq) claimedSender() []byte {
+	return req.FromId
+}
+
+func (req *HandOffReq) claimedSender() []byte {
+	return req.FromId
+}
+
+func (req *UpdateReq) claimedSender() []byte {
+	return req.SenderId
+}
+
+/* Handlers changing membership or replicas, only other nodes may call them, clients may not */
+var memberMethods = map[string]bool{
+	"SetPredecessorId":      true,
+	"SetSuccessorId":        true,
+	"Notify_Handler":        true,
+	"TransferKeys_Handler":  true,
+	"HandOffKeys_Handler":   true,
+	"RepairReplica_Handler": true,
+}
+
+/*
+Server codec rejecting requests that claim to come from another node than
+the peer, and member-only requests from a peer that is no node
+*/
+type peerCheckCodec struct {
+	rpc.ServerCodec
+	peer    []byte /* ID in the peer's certificate, nil if it has none */
+	peerKey []byte /* ID derived from the peer's public key */
+	member  bool   /* Certificate names a node, see serveConn */
+	method  string /* Of the request whose body is read next */
+}
+
+func (codec *peerCheckCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := codec.ServerCodec.ReadRequestHeader(r)
+	codec.method = handlerName(r.ServiceMethod)
+	return err
+}
+
+func (codec *peerCheckCodec) ReadRequestBody(body interface{}) error {
+	if err := codec.ServerCodec.ReadRequestBody(body); err != nil || body == nil {
+		return err
+	}
+	if memberMethods[codec.method] && !codec.member {
+		return errors.New(fmt.Sprintf("%v is for ring members, peer certificate names no node", codec.method))
+	}
+	claim, ok := body.(senderClaim)
+	if !ok || EqualIds(claim.claimedSender(), codec.peer) || EqualIds(claim.claimedSender(), codec.peerKey) {
+		return nil
+	}
+	// net/rpc sends this back as the call's error and keeps the connection
+	return errors.New(fmt.Sprintf("request claims to be from node %v, certificate is for %v",
+		HashStr(claim.claimedSender()), HashStr(codec.peer)))
+}
+
+/*
+Serve RPCs on conn in the codec its first bytes announce, checking the
+peer's certificate first if conn is TLS and every request's signature if we
+have a cluster secret, and refusing what goes over our load limits
+*/
+func (node *Node) serveConn(conn net.Conn) {
+	peerAddr := peerHost(conn)
+	overloaded := !node.load.openConn(peerAddr)
+	if overloaded {
+		node.log.Warn("too many connections", "peer", conn.RemoteAddr(), "max", node.config.MaxConns)
+	} else {
+		defer node.load.closeConn(peerAddr)
+	}
+
+	var peerCheck *peerCheckCodec
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(TLS_HANDSHAKE_TIMEOUT))
+		if err := tlsConn.Handshake(); err != nil {
+			node.log.Warn("TLS handshake failed", "peer", conn.RemoteAddr(), "err", err)
+			conn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		cert := tlsConn.ConnectionState().PeerCertificates[0]
+		peer, err := certId(cert)
+		if err != nil {
+			node.log.Warn("bad peer certificate", "peer", conn.RemoteAddr(), "err", err)
+			conn.Close()
+			return
+		}
+		// under the key scheme node certificates carry no ID, and cannot be told from clients'
+		member := peer != nil || node.config.IdScheme == ID_SCHEME_PUBLIC_KEY
+		peerCheck = &peerCheckCodec{ServerCodec: nil, peer: peer, peerKey: PublicKeyId(cert), member: member}
+	}
+
+	if overloaded {
+		// long enough to tell the client to back off, then hang up
+		conn.SetDeadline(time.Now().Add(OVERLOAD_CONN_GRACE))
+	}
+
+	wire, sniffed, err := sniffCodec(conn)
+	if err != nil {
+		if err != io.EOF {
+			node.log.Warn("unreadable connection", "peer", conn.RemoteAddr(), "err", err)
+		}
+		conn.Close()
+		return
+	}
+	codec := newServerCodec(wire, sniffed)
+	if node.config.ClusterSecret != nil {
+		codec = newAuthServerCodec(node, codec, wire)
+	}
+	if peerCheck != nil {
+		peerCheck.ServerCodec = codec
+		codec = peerCheck
+	}
+	codec = newLimitServerCodec(node, peerAddr, codec, overloaded)
+	rpc.ServeCodec(newMetricsServerCodec(node, codec))
+}
+
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+
+/*
+Write a self-signed CA and certificates for a local test ring into dir
+
+	ca.pem, ca-key.pem                the CA every node and client trusts
+	node-<id>.pem, node-<id>-key.pem  one per entry of nodeIds, carrying the ID,
+	                                  then keyNodes more without one, named by
+	                                  the ID derived from their key
+	client.pem, client-key.pem        for Clients and the CLI, without an ID
+
+not meant for production, keys are unencrypted and certificates are valid
+for a year.
+*/
+func GenerateTestCertificates(dir string, nodeIds [][]byte, keyNodes int) error {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	caTemplate := certTemplate("chord test CA")
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	caCert, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		return err
+	}
+	if err := writePem(dir, "ca", caDer, caKey); err != nil {
+		return err
+	}
+
+	// an empty name names the certificate after its key
+	issue := func(name string, id []byte) error {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			spki, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+			if err != nil {
+				return err
+			}
+			name = "node-" + HashStr(HashKey(string(spki)))
+		}
+		template := certTemplate(name)
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		if id != nil {
+			template.URIs = []*url.URL{{Scheme: CERT_ID_SCHEME, Opaque: HashStr(id)}}
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			return err
+		}
+		return writePem(dir, name, der, key)
+	}
+	for _, id := range nodeIds {
+		if err := issue("node-"+HashStr(id), id); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < keyNodes; i++ {
+		if err := issue("", nil); err != nil {
+			return err
+		}
+	}
+	return issue("client", nil)
+}
+
+func certTemplate(name string) *x509.Certificate {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+	}
+}
+
+/* dir/name.pem and dir/name-key.pem */
+func writePem(dir string, name string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".pem"), certPem, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPem, 0600)
+}
@@ -0,0 +1,193 @@
+package chord
+
+import (
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTestCertificatesCarryIds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chord-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := GenerateTestCertificates(dir, [][]byte{{42}}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	load := func(name string) ([]byte, [][]byte) {
+		config := &TLSConfig{filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem"), filepath.Join(dir, "ca.pem")}
+		tlsConfig, cert, err := loadTLS(config)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		id, err := certId(cert)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		return id, tlsConfig.Certificates[0].Certificate
+	}
+	id, chain := load("node-42")
+	if !EqualIds(id, []byte{42}) {
+		t.Errorf("node certificate has ID %v, want 42", HashStr(id))
+	}
+	id, clientChain := load("client")
+	if id != nil {
+		t.Errorf("client certificate has ID %v, want none", HashStr(id))
+	}
+
+	tlsConfig, _, _ := loadTLS(&TLSConfig{filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem"), filepath.Join(dir, "ca.pem")})
+	if err := verifyPeer(chain, tlsConfig.RootCAs, []byte{42}, "node-42"); err != nil {
+		t.Errorf("node 42 rejected: %v", err)
+	}
+	if err := verifyPeer(chain, tlsConfig.RootCAs, []byte{43}, "node-42"); err == nil {
+		t.Errorf("node 42 accepted as node 43")
+	}
+	// a node dialled without an ID matches neither an ID-less certificate nor any other
+	for _, c := range [][][]byte{clientChain, chain} {
+		if err := verifyPeer(c, tlsConfig.RootCAs, nil, "node-42"); err == nil {
+			t.Errorf("certificate accepted for a node without an ID")
+		}
+	}
+}
+
+func TestChooseId(t *testing.T) {
+	addr := "localhost:7000"
+	if id, _ := chooseId(addr, nil, ID_SCHEME_ANY, nil); !EqualIds(id, HashKey(addr)) {
+		t.Errorf("default ID %v, want hash of address", HashStr(id))
+	}
+	if id, _ := chooseId(addr, []byte{42}, ID_SCHEME_ANY, nil); !EqualIds(id, []byte{42}) {
+		t.Errorf("defined ID %v, want 42", HashStr(id))
+	}
+	if _, err := chooseId(addr, []byte{42}, ID_SCHEME_ADDRESS, nil); err == nil {
+		t.Errorf("defined ID accepted under the address scheme")
+	}
+	if _, err := chooseId(addr, nil, ID_SCHEME_PUBLIC_KEY, nil); err == nil {
+		t.Errorf("key scheme accepted without a certificate")
+	}
+
+	node := &Node{config: &Config{IdScheme: ID_SCHEME_ADDRESS}, Id: []byte{1}}
+	peer := newTestNode(t, []byte{0})
+	peer.Id = HashKey(peer.Addr)
+	if err := node.checkPeerId(&RemoteNode{peer.Id, peer.Addr}); err != nil {
+		t.Errorf("address-derived peer refused: %v", err)
+	}
+	if err := node.checkPeerId(&RemoteNode{[]byte{42}, peer.Addr}); err == nil {
+		t.Errorf("made up peer ID accepted")
+	}
+	// derived from the address, but nobody answers there under it
+	if err := node.checkPeerId(&RemoteNode{HashKey(addr), addr}); err == nil {
+		t.Errorf("peer accepted without answering at its address")
+	}
+	other := newTestNode(t, []byte{0})
+	other.Id = []byte{HashKey(other.Addr)[0] ^ 1}
+	if err := node.checkPeerId(&RemoteNode{HashKey(other.Addr), other.Addr}); err == nil {
+		t.Errorf("peer accepted with the ID of its address while node %v answers there", HashStr(other.Id))
+	}
+}
+
+/* Server codec handing out one request with a body decoded beforehand */
+type stubServerCodec struct {
+	method string
+}
+
+func (codec *stubServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	r.ServiceMethod = "127.0.0.1:1." + codec.method
+	return nil
+}
+func (codec *stubServerCodec) ReadRequestBody(body interface{}) error                { return nil }
+func (codec *stubServerCodec) WriteResponse(r *rpc.Response, body interface{}) error { return nil }
+func (codec *stubServerCodec) Close() error                                          { return nil }
+
+func TestPeerCheckCodec(t *testing.T) {
+	read := func(codec *peerCheckCodec, method string, body interface{}) error {
+		codec.ServerCodec = &stubServerCodec{method}
+		var r rpc.Request
+		codec.ReadRequestHeader(&r)
+		return codec.ReadRequestBody(body)
+	}
+	client := &peerCheckCodec{peerKey: []byte{9}}
+	if err := read(client, "PutLocal_Handler", &KeyValueReq{}); err != nil {
+		t.Errorf("client refused a put: %v", err)
+	}
+	for _, method := range []string{"SetPredecessorId", "SetSuccessorId", "RepairReplica_Handler", "HandOffKeys_Handler"} {
+		if err := read(client, method, &RepairReq{}); err == nil {
+			t.Errorf("client certificate allowed to call %v", method)
+		}
+	}
+
+	node := &peerCheckCodec{peer: []byte{42}, peerKey: []byte{9}, member: true}
+	if err := read(node, "SetSuccessorId", &UpdateReq{SenderId: []byte{42}}); err != nil {
+		t.Errorf("node 42 refused in its own name: %v", err)
+	}
+	if err := read(node, "SetSuccessorId", &UpdateReq{SenderId: []byte{43}}); err == nil {
+		t.Errorf("node 42 allowed to update pointers as node 43")
+	}
+}
+
+func TestSetNeighbours(t *testing.T) {
+	nodes := newTestRing(t, 10, 100, 200)
+	first, leaving, last := nodes[0], nodes[1], nodes[2]
+
+	if err := SetPredecessorId_RPC(last.RemoteSelf, first.RemoteSelf, first.RemoteSelf); err == nil {
+		t.Errorf("node 10 moved the predecessor of 200 without being it")
+	}
+	if err := SetPredecessorId_RPC(last.RemoteSelf, leaving.RemoteSelf, first.RemoteSelf); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetSuccessorId_RPC(first.RemoteSelf, leaving.RemoteSelf, last.RemoteSelf); err != nil {
+		t.Fatal(err)
+	}
+	if !EqualIds(last.Predecessor.Id, first.Id) || !EqualIds(first.Successor.Id, last.Id) ||
+		!EqualIds(first.FingerTable[0].Node.Id, last.Id) {
+		t.Errorf("10 -> %v, %v <- 200 after 100 left", HashStr(first.Successor.Id), HashStr(last.Predecessor.Id))
+	}
+	if !EqualIds(leaving.RemoteSelf.Id, leaving.Id) {
+		t.Errorf("the leaving node's own RemoteNode was rewritten")
+	}
+}
+
+func TestDialGivesUpOnSilentNode(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// accept, then never answer the handshake
+	go func() {
+		var held []net.Conn
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				for _, c := range held {
+					c.Close()
+				}
+				return
+			}
+			held = append(held, conn)
+		}
+	}()
+	saved := DIAL_TIMEOUT
+	DIAL_TIMEOUT = 100 * time.Millisecond
+	defer func() { DIAL_TIMEOUT = saved }()
+
+	silent := &RemoteNode{[]byte{77}, listener.Addr().String()}
+	start := time.Now()
+	if _, err := cachedClient(silent); err == nil {
+		t.Fatal("dial to a silent node succeeded")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("dial gave up after %v", took)
+	}
+	connLock.Lock()
+	_, cached := connMap[silent.Addr]
+	connLock.Unlock()
+	if cached {
+		t.Errorf("failed dial left a client in connMap")
+	}
+}
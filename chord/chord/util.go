@@ -9,6 +9,7 @@ package chord
 import (
 	"bytes"
 	"crypto/sha1"
+	"fmt"
 	"math/big"
 )
 
@@ -68,7 +69,8 @@ func Between(nodeX, nodeA, nodeB []byte) bool {
 	} else if aInt.Cmp(&bInt) < 0 {
 		result = (xInt.Cmp(&aInt) == 1 && xInt.Cmp(&bInt) == -1)
 	} else {
-		result = !(xInt.Cmp(&bInt) == 1 && xInt.Cmp(&aInt) == -1)
+		// the interval wraps past zero, neither end is in it
+		result = xInt.Cmp(&aInt) == 1 || xInt.Cmp(&bInt) == -1
 	}
 
 	return result
@@ -140,3 +142,15 @@ func PrintFingerTable(node *Node) {
 			HashStr(val.Start), HashStr(val.Node.Id), val.Node.Addr)
 	}
 }
+
+/* Parse a decimal ID, as printed by HashStr, back into a KEY_LENGTH bit ID */
+func ParseId(s string) ([]byte, error) {
+	idInt, ok := new(big.Int).SetString(s, 10)
+	if !ok || idInt.Sign() < 0 || idInt.BitLen() > KEY_LENGTH {
+		return nil, fmt.Errorf("%q is not a valid %v bit id", s, KEY_LENGTH)
+	}
+	id := make([]byte, KEY_LENGTH/8)
+	b := idInt.Bytes()
+	copy(id[len(id)-len(b):], b)
+	return id, nil
+}
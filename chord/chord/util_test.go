@@ -0,0 +1,35 @@
+package chord
+
+import (
+	"testing"
+)
+
+func TestBetweenExcludesBothEnds(t *testing.T) {
+	tests := []struct {
+		x, a, b   byte
+		between   bool
+		rightIncl bool
+	}{
+		{50, 10, 100, true, true},
+		{10, 10, 100, false, false},
+		{100, 10, 100, false, true},
+		// wrapping past zero
+		{250, 200, 50, true, true},
+		{5, 200, 50, true, true},
+		{200, 200, 50, false, false},
+		{50, 200, 50, false, true},
+		{100, 200, 50, false, false},
+		// a == b: empty open interval, the whole ring with b included
+		{10, 10, 10, false, true},
+		{70, 10, 10, false, true},
+	}
+	for _, tt := range tests {
+		x, a, b := []byte{tt.x}, []byte{tt.a}, []byte{tt.b}
+		if got := Between(x, a, b); got != tt.between {
+			t.Errorf("Between(%v, %v, %v) = %v", tt.x, tt.a, tt.b, got)
+		}
+		if got := BetweenRightIncl(x, a, b); got != tt.rightIncl {
+			t.Errorf("BetweenRightIncl(%v, %v, %v) = %v", tt.x, tt.a, tt.b, got)
+		}
+	}
+}
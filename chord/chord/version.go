@@ -0,0 +1,190 @@
+/*                                                                           */
+/*  Purpose: Protocol version and capabilities, exchanged once per           */
+/*           connection so mixed-version rings fail cleanly.                 */
+/*                                                                           */
+
+package chord
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"strings"
+	"sync"
+)
+
+/*
+Version of the protocol this node speaks, and the oldest it still talks to
+
+bump PROTOCOL_VERSION when a request or reply changes meaning, not when a
+field is added: gob and JSON both skip fields the receiver does not know and
+leave missing ones at their zero value, so new fields must have a zero value
+that means "as before". A feature an older node would silently ignore gets a
+capability instead, see CAPABILITIES.
+
+Nodes from before the handshake have no Hello_Handler and count as version 0.
+*/
+const PROTOCOL_VERSION = 1
+const MIN_PROTOCOL_VERSION = 0
+
+/* Optional features, named in the handshake */
+const (
+	CAP_TTL      = "ttl"      /* Keys that expire, KeyValueReq.TTL */
+	CAP_BATCH    = "batch"    /* GetLocalMany/PutLocalMany */
+	CAP_WATCH    = "watch"    /* Key and prefix watches */
+	CAP_RANGE    = "range"    /* GetRange, used by export */
+	CAP_REPLICAS = "replicas" /* Replica repair and versioned quorum reads/writes */
+	CAP_PING     = "ping"     /* Ping, for RTTs of finger candidates */
+	CAP_HANDOFF  = "handoff"  /* HandOffKeys, keys moved with their versions past the owner check */
+	CAP_DELETE   = "delete"   /* Versioned deletes that leave a tombstone, VersionedReq.Deleted and HandOffReq.Deleted */
+)
+
+/* Everything this node supports */
+var CAPABILITIES = []string{CAP_TTL, CAP_BATCH, CAP_WATCH, CAP_RANGE, CAP_REPLICAS, CAP_PING, CAP_HANDOFF, CAP_DELETE}
+
+/* Error prefix of a handshake between versions that cannot work together */
+const ERR_INCOMPATIBLE = "Incompatible protocol"
+
+/* Error prefix of a call the remote node lacks the capability for */
+const ERR_UNSUPPORTED = "Not supported by remote node"
+
+/* Capability a handler needs the remote node to have */
+var methodCapabilities = map[string]string{
+	"GetLocalMany_Handler":  CAP_BATCH,
+	"PutLocalMany_Handler":  CAP_BATCH,
+	"Watch_Handler":         CAP_WATCH,
+	"PollWatch_Handler":     CAP_WATCH,
+	"Unwatch_Handler":       CAP_WATCH,
+	"GetRange_Handler":      CAP_RANGE,
+	"MerkleHashes_Handler":  CAP_REPLICAS,
+	"BucketDigests_Handler": CAP_REPLICAS,
+	"RepairReplica_Handler": CAP_REPLICAS,
+	"ReplicaSet_Handler":    CAP_REPLICAS,
+	"GetVersioned_Handler":  CAP_REPLICAS,
+	"PutVersioned_Handler":  CAP_REPLICAS,
+	"Ping_Handler":          CAP_PING,
+	"HandOffKeys_Handler":   CAP_HANDOFF,
+}
+
+/* Requests that need capabilities depending on what they carry */
+type capabilityUser interface {
+	capabilities() []string
+}
+
+func (req *KeyValueReq) capabilities() []string {
+	if req.TTL > 0 {
+		return []string{CAP_TTL}
+	}
+	return nil
+}
+
+func (req *VersionedReq) capabilities() []string {
+	if req.Deleted {
+		return []string{CAP_DELETE}
+	}
+	return nil
+}
+
+func (req *HandOffReq) capabilities() []string {
+	for _, deleted := range req.Deleted {
+		if deleted {
+			return []string{CAP_DELETE}
+		}
+	}
+	return nil
+}
+
+func (req *KeyValueBatchReq) capabilities() []string {
+	for i := range req.Reqs {
+		if req.Reqs[i].TTL > 0 {
+			return []string{CAP_TTL}
+		}
+	}
+	return nil
+}
+
+/* What a peer said in its handshake */
+type PeerProtocol struct {
+	Version      int
+	Capabilities []string
+}
+
+func (peer *PeerProtocol) supports(capability string) bool {
+	for _, c := range peer.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+/* Handshakes of the peers we have connections to, by address */
+var peerProtocols = make(map[string]*PeerProtocol)
+var peerProtocolsLock sync.RWMutex
+
+/* What the node at addr said in its last handshake with this process, nil if none */
+func PeerProtocolOf(addr string) *PeerProtocol {
+	peerProtocolsLock.RLock()
+	defer peerProtocolsLock.RUnlock()
+	return peerProtocols[addr]
+}
+
+/* Can a node speaking [min, version] talk to us? */
+func compatible(version int, min int) error {
+	if version < MIN_PROTOCOL_VERSION || min > PROTOCOL_VERSION {
+		return errors.New(fmt.Sprintf("%v: peer speaks versions %v to %v, we speak %v to %v",
+			ERR_INCOMPATIBLE, min, version, MIN_PROTOCOL_VERSION, PROTOCOL_VERSION))
+	}
+	return nil
+}
+
+/*
+Exchange versions and capabilities on a new connection to remoteNode
+
+refused by either side when the versions cannot work together. A node
+without Hello_Handler predates the handshake and is taken as version 0
+without capabilities.
+*/
+func handshake(client *rpc.Client, remoteNode *RemoteNode) error {
+	req := HelloReq{PROTOCOL_VERSION, MIN_PROTOCOL_VERSION, CAPABILITIES}
+	var reply HelloReply
+	err := client.Call(fmt.Sprintf("%v.Hello_Handler", remoteNode.Addr), &req, &reply)
+	if err != nil && strings.HasPrefix(err.Error(), "rpc: can't find method") {
+		reply, err = HelloReply{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := compatible(reply.Version, reply.MinVersion); err != nil {
+		return err
+	}
+	peerProtocolsLock.Lock()
+	peerProtocols[remoteNode.Addr] = &PeerProtocol{reply.Version, reply.Capabilities}
+	peerProtocolsLock.Unlock()
+	return nil
+}
+
+/* Refuse a call to addr that it would not understand */
+func checkCapabilities(addr string, method string, req interface{}) error {
+	needed := []string{}
+	if capability, ok := methodCapabilities[method]; ok {
+		needed = append(needed, capability)
+	}
+	if user, ok := req.(capabilityUser); ok {
+		needed = append(needed, user.capabilities()...)
+	}
+	if len(needed) == 0 {
+		return nil
+	}
+	peer := PeerProtocolOf(addr)
+	if peer == nil {
+		return nil
+	}
+	for _, capability := range needed {
+		if !peer.supports(capability) {
+			return errors.New(fmt.Sprintf("%v: %v (protocol %v) has no %v for %v",
+				ERR_UNSUPPORTED, addr, peer.Version, capability, method))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package chord
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+func TestCompatible(t *testing.T) {
+	if err := compatible(PROTOCOL_VERSION, MIN_PROTOCOL_VERSION); err != nil {
+		t.Errorf("refused our own version: %v", err)
+	}
+	if err := compatible(0, 0); err != nil {
+		t.Errorf("refused nodes from before the handshake: %v", err)
+	}
+	if err := compatible(PROTOCOL_VERSION+2, PROTOCOL_VERSION+1); err == nil {
+		t.Errorf("accepted a peer that only speaks newer versions")
+	}
+}
+
+func TestUnknownFieldsIgnored(t *testing.T) {
+	// a newer node's request with a field we don't know yet
+	type newerKeyValueReq struct {
+		NodeId   []byte
+		Key      string
+		Value    string
+		Priority int
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(newerKeyValueReq{[]byte{1}, "k", "v", 3}); err != nil {
+		t.Fatal(err)
+	}
+	var req KeyValueReq
+	if err := gob.NewDecoder(&buf).Decode(&req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Key != "k" || req.Value != "v" || req.TTL != 0 {
+		t.Errorf("decoded %+v", req)
+	}
+}
+
+func TestCheckCapabilities(t *testing.T) {
+	peerProtocolsLock.Lock()
+	peerProtocols["old:1"] = &PeerProtocol{0, nil}
+	peerProtocolsLock.Unlock()
+	defer func() {
+		peerProtocolsLock.Lock()
+		delete(peerProtocols, "old:1")
+		peerProtocolsLock.Unlock()
+	}()
+
+	if err := checkCapabilities("old:1", "PutLocal_Handler", &KeyValueReq{Key: "k"}); err != nil {
+		t.Errorf("plain put refused: %v", err)
+	}
+	if err := checkCapabilities("old:1", "PutLocal_Handler", &KeyValueReq{Key: "k", TTL: 5}); err == nil {
+		t.Errorf("put with TTL sent to a node without ttl")
+	}
+	if err := checkCapabilities("old:1", "RepairReplica_Handler", RepairReq{}); err == nil {
+		t.Errorf("repair sent to a node without replicas")
+	}
+}
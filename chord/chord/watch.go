@@ -0,0 +1,447 @@
+/*                                                                           */
+/*  Purpose: Watches on keys and key prefixes. Nodes keep subscriptions and  */
+/*           queue put/delete/expire events, watchers long-poll for them.    */
+/*                                                                           */
+
+package chord
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Kinds of WatchEvent */
+const (
+	WATCH_PUT    = "put"
+	WATCH_DELETE = "delete"
+	WATCH_EXPIRE = "expire"
+)
+
+/* Events kept per subscription for watchers that fall behind, older ones are dropped */
+const WATCH_BUFFER = 1024
+
+/* Subscriptions nobody polled for this long are dropped */
+const WATCH_IDLE_TIMEOUT = time.Minute
+
+/* How long a single PollWatch_RPC waits on the node before returning empty */
+const WATCH_POLL_WAIT = 5 * time.Second
+
+/* A change to a watched key */
+type WatchEvent struct {
+	Seq   uint64 /* Increasing per subscription and node */
+	Type  string /* One of the WATCH_* constants */
+	Key   string
+	Value string /* New value for puts, empty otherwise */
+}
+
+/*
+A watch registered on this node
+
+key watches live on the key's owner only and follow the key when it is
+transferred. Prefix watches live on every node of the ring, since the keys
+of a prefix hash all over it, and are copied to nodes that join.
+*/
+type subscription struct {
+	id       string
+	key      string
+	prefix   bool
+	events   []WatchEvent
+	seq      uint64
+	wake     chan struct{} /* Closed and replaced whenever an event is queued */
+	lastPoll time.Time
+	movedTo  *RemoteNode            /* Set once a key watch followed its key elsewhere */
+	copiedTo map[string]*RemoteNode /* Nodes a prefix watch was copied to, by address */
+}
+
+func (sub *subscription) matches(key string) bool {
+	if sub.prefix {
+		return strings.HasPrefix(key, sub.key)
+	}
+	return sub.key == key
+}
+
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+
+/*
+node side: registering, queueing events and moving subscriptions around
+*/
+
+/* Register a subscription, registering an existing id again is a no-op */
+func (node *Node) addWatch(id string, key string, prefix bool) {
+	node.watchLock.Lock()
+	defer node.watchLock.Unlock()
+	if sub, ok := node.watches[id]; ok && sub.movedTo == nil {
+		return
+	}
+	node.watches[id] = &subscription{
+		id:       id,
+		key:      key,
+		prefix:   prefix,
+		wake:     make(chan struct{}),
+		lastPoll: time.Now(),
+		copiedTo: make(map[string]*RemoteNode),
+	}
+}
+
+func (node *Node) removeWatch(id string) {
+	node.watchLock.Lock()
+	delete(node.watches, id)
+	node.watchLock.Unlock()
+}
+
+/* Queue an event on every subscription watching key */
+func (node *Node) emitWatch(kind string, key string, value string) {
+	node.watchLock.Lock()
+	defer node.watchLock.Unlock()
+	for _, sub := range node.watches {
+		if sub.movedTo != nil || !sub.matches(key) {
+			continue
+		}
+		sub.seq++
+		sub.events = append(sub.events, WatchEvent{sub.seq, kind, key, value})
+		if len(sub.events) > WATCH_BUFFER {
+			sub.events = sub.events[len(sub.events)-WATCH_BUFFER:]
+		}
+		close(sub.wake)
+		sub.wake = make(chan struct{})
+	}
+}
+
+/* Events after seq after, waiting up to wait for one to show up */
+func (node *Node) pollWatch(id string, after uint64, wait time.Duration, reply *PollWatchReply) {
+	if wait > WATCH_POLL_WAIT {
+		wait = WATCH_POLL_WAIT
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		node.watchLock.Lock()
+		sub, ok := node.watches[id]
+		if !ok {
+			node.watchLock.Unlock()
+			reply.Unknown = true
+			return
+		}
+		sub.lastPoll = time.Now()
+		reply.AlsoOn = nil
+		for _, n := range sub.copiedTo {
+			reply.AlsoOn = append(reply.AlsoOn, n)
+		}
+		if sub.movedTo != nil {
+			// watcher knows where to go now, forget about it
+			reply.MovedTo = sub.movedTo
+			delete(node.watches, id)
+			node.watchLock.Unlock()
+			return
+		}
+		for _, ev := range sub.events {
+			if ev.Seq > after {
+				reply.Events = append(reply.Events, ev)
+			}
+		}
+		wake := sub.wake
+		node.watchLock.Unlock()
+
+		if len(reply.Events) > 0 {
+			return
+		}
+		select {
+		case <-wake:
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+/*
+hand subscriptions over to dest, which now owns the ids in (from, to]
+
+key watches for keys in the range move and are left behind as a pointer to
+dest for the watcher's next poll. Prefix watches are copied once, dest
+needs them too.
+*/
+func (node *Node) migrateWatches(from []byte, to []byte, dest *RemoteNode) {
+	if dest == nil || EqualIds(dest.Id, node.Id) {
+		return
+	}
+	node.watchLock.Lock()
+	var moving []*subscription
+	for _, sub := range node.watches {
+		if sub.movedTo != nil {
+			continue
+		}
+		if sub.prefix {
+			if _, ok := sub.copiedTo[dest.Addr]; !ok {
+				moving = append(moving, sub)
+			}
+		} else if BetweenRightIncl(HashKey(sub.key), from, to) {
+			moving = append(moving, sub)
+		}
+	}
+	node.watchLock.Unlock()
+
+	// register remotely without holding the lock
+	for _, sub := range moving {
+		if err := Watch_RPC(dest, sub.id, sub.key, sub.prefix); err != nil {
+			node.log.Warn("could not hand watch over", "sub", sub.id, "to", dest.Addr, "err", err)
+			continue
+		}
+		node.watchLock.Lock()
+		if sub.prefix {
+			sub.copiedTo[dest.Addr] = dest
+		} else {
+			sub.movedTo = dest
+		}
+		node.watchLock.Unlock()
+	}
+}
+
+/* On shutdown every subscription moves to our successor */
+func (node *Node) handOffWatches(succ *RemoteNode) {
+	if succ == nil || EqualIds(succ.Id, node.Id) {
+		return
+	}
+	node.watchLock.Lock()
+	var moving []*subscription
+	for _, sub := range node.watches {
+		if sub.movedTo == nil {
+			moving = append(moving, sub)
+		}
+	}
+	node.watchLock.Unlock()
+
+	for _, sub := range moving {
+		if err := Watch_RPC(succ, sub.id, sub.key, sub.prefix); err != nil {
+			node.log.Warn("could not hand watch over", "sub", sub.id, "to", succ.Addr, "err", err)
+			continue
+		}
+		node.watchLock.Lock()
+		sub.movedTo = succ
+		node.watchLock.Unlock()
+	}
+}
+
+/* Drop subscriptions whose watcher went away */
+func (node *Node) expireIdleWatches(now time.Time) {
+	node.watchLock.Lock()
+	for id, sub := range node.watches {
+		if now.Sub(sub.lastPoll) > WATCH_IDLE_TIMEOUT {
+			delete(node.watches, id)
+		}
+	}
+	node.watchLock.Unlock()
+}
+
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////////////
+
+/*
+client side: long-polling every node that holds the subscription
+*/
+
+/*
+Stream of changes to a key or key prefix
+
+Events delivers put, delete and expire events until Close. Each node holding
+the subscription is long-polled; the watcher follows a key watch when its key
+moves to another node and picks up nodes a prefix watch got copied to.
+Events raised while a subscription is in flight between nodes can be missed.
+*/
+type Watcher struct {
+	Events <-chan WatchEvent
+
+	events  chan WatchEvent
+	client  *Client
+	id      string
+	key     string
+	prefix  bool
+	lock    sync.Mutex
+	polling map[string]*RemoteNode /* Nodes being polled, by address */
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+/* Watch a single key, registered on its owner */
+func (client *Client) Watch(key string) (*Watcher, error) {
+	watcher := client.newWatcher(key, false)
+	owner, err := watcher.registerKey()
+	if err != nil {
+		return nil, err
+	}
+	watcher.startPolling(owner)
+	return watcher, nil
+}
+
+/* Watch every key starting with prefix, registered on every node of the ring */
+func (client *Client) WatchPrefix(prefix string) (*Watcher, error) {
+	watcher := client.newWatcher(prefix, true)
+	nodes, err := walkRing(client.bootstrap, new(RingReport))
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		if err := Watch_RPC(n, watcher.id, prefix, true); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+		watcher.startPolling(n)
+	}
+	return watcher, nil
+}
+
+/* Stop watching, Events is closed once every poller has stopped */
+func (watcher *Watcher) Close() {
+	watcher.lock.Lock()
+	select {
+	case <-watcher.done:
+		watcher.lock.Unlock()
+		return
+	default:
+	}
+	close(watcher.done)
+	nodes := make([]*RemoteNode, 0, len(watcher.polling))
+	for _, n := range watcher.polling {
+		nodes = append(nodes, n)
+	}
+	watcher.lock.Unlock()
+
+	for _, n := range nodes {
+		Unwatch_RPC(n, watcher.id)
+	}
+	watcher.wg.Wait()
+	close(watcher.events)
+}
+
+func (client *Client) newWatcher(key string, prefix bool) *Watcher {
+	watcher := &Watcher{
+		events:  make(chan WatchEvent, WATCH_BUFFER),
+		client:  client,
+		id:      newWatchId(),
+		key:     key,
+		prefix:  prefix,
+		polling: make(map[string]*RemoteNode),
+		done:    make(chan struct{}),
+	}
+	watcher.Events = watcher.events
+	return watcher
+}
+
+/* Register a key watch on the key's owner, following redirects */
+func (watcher *Watcher) registerKey() (*RemoteNode, error) {
+	owner, err := watcher.client.lookupId(HashKey(watcher.key))
+	for redirects := 0; err == nil; redirects++ {
+		err = Watch_RPC(owner, watcher.id, watcher.key, false)
+		wrong, ok := err.(*WrongOwnerError)
+		if !ok || wrong.Owner == nil || redirects == MAX_REDIRECTS {
+			break
+		}
+		owner = wrong.Owner
+	}
+	if err != nil {
+		return nil, err
+	}
+	return owner, nil
+}
+
+/* Start a poller for n unless one is running already or we are closed */
+func (watcher *Watcher) startPolling(n *RemoteNode) {
+	watcher.lock.Lock()
+	defer watcher.lock.Unlock()
+	select {
+	case <-watcher.done:
+		return
+	default:
+	}
+	if _, ok := watcher.polling[n.Addr]; ok {
+		return
+	}
+	watcher.polling[n.Addr] = n
+	watcher.wg.Add(1)
+	go watcher.poll(n)
+}
+
+func (watcher *Watcher) stopPolling(n *RemoteNode) {
+	watcher.lock.Lock()
+	delete(watcher.polling, n.Addr)
+	watcher.lock.Unlock()
+}
+
+/*
+long-poll n until the subscription leaves it
+
+when n fails or forgets the subscription, a key watch is registered again on
+the key's current owner; a prefix watch gives n up, its keys are now served
+by a successor that already holds the subscription.
+*/
+func (watcher *Watcher) poll(n *RemoteNode) {
+	defer watcher.wg.Done()
+	var after uint64
+	for {
+		select {
+		case <-watcher.done:
+			return
+		default:
+		}
+
+		reply, err := PollWatch_RPC(n, watcher.id, after, WATCH_POLL_WAIT)
+		if err != nil || reply.Unknown {
+			watcher.stopPolling(n)
+			if !watcher.prefix {
+				watcher.reregister()
+			}
+			return
+		}
+		for _, ev := range reply.Events {
+			after = ev.Seq
+			select {
+			case watcher.events <- ev:
+			case <-watcher.done:
+				return
+			}
+		}
+		for _, other := range reply.AlsoOn {
+			watcher.startPolling(other)
+		}
+		if reply.MovedTo != nil {
+			watcher.stopPolling(n)
+			watcher.startPolling(reply.MovedTo)
+			return
+		}
+	}
+}
+
+/* Key watch lost its node, find the owner again, retrying until closed */
+func (watcher *Watcher) reregister() {
+	for {
+		owner, err := watcher.registerKey()
+		if err == nil {
+			watcher.startPolling(owner)
+			return
+		}
+		select {
+		case <-watcher.done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+/* Random subscription id, unique across watchers */
+func newWatchId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// should never happen, the clock still keeps ids apart
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
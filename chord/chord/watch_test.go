@@ -0,0 +1,84 @@
+package chord
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestWatchEvents(t *testing.T) {
+	node := newTestRing(t, 50)[0]
+	node.addWatch("key", "a", false)
+	node.addWatch("prefix", "user/", true)
+
+	for _, k := range []string{"a", "b", "user/1"} {
+		var reply KeyValueReply
+		if err := node.PutLocal_Handler(&KeyValueReq{node.Id, k, "v-" + k, 0}, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, k := range []string{"a", "missing"} {
+		var reply KeyValueReply
+		if err := node.DeleteLocal_Handler(&KeyValueReq{node.Id, k, "", 0}, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var keyReply PollWatchReply
+	node.pollWatch("key", 0, 0, &keyReply)
+	if len(keyReply.Events) != 2 || keyReply.Events[0] != (WatchEvent{1, WATCH_PUT, "a", "v-a"}) ||
+		keyReply.Events[1] != (WatchEvent{2, WATCH_DELETE, "a", ""}) {
+		t.Errorf("key watch got %v", keyReply.Events)
+	}
+	var prefixReply PollWatchReply
+	node.pollWatch("prefix", 0, 0, &prefixReply)
+	if len(prefixReply.Events) != 1 || prefixReply.Events[0].Key != "user/1" {
+		t.Errorf("prefix watch got %v", prefixReply.Events)
+	}
+	var laterReply PollWatchReply
+	node.pollWatch("key", 1, 0, &laterReply)
+	if len(laterReply.Events) != 1 || laterReply.Events[0].Seq != 2 {
+		t.Errorf("events after 1: %v", laterReply.Events)
+	}
+}
+
+func TestWatchesFollowTransferredKeys(t *testing.T) {
+	nodes := newTestRing(t, 10, 200)
+	// a key 100 takes over from 200 when it joins between them
+	key := ""
+	for i := 0; key == ""; i++ {
+		if k := fmt.Sprintf("k%v", i); BetweenRightIncl(HashKey(k), []byte{10}, []byte{100}) {
+			key = k
+		}
+	}
+	nodes[1].addWatch("key", key, false)
+	nodes[1].addWatch("prefix", "k", true)
+	putOnOwners(nodes, key)
+
+	joining := newTestNode(t, []byte{100})
+	joining.Successor = nodes[1].RemoteSelf
+	nodes[1].notify(joining.RemoteSelf)
+
+	var moved PollWatchReply
+	nodes[1].pollWatch("key", 0, 0, &moved)
+	if moved.MovedTo == nil || !EqualIds(moved.MovedTo.Id, joining.Id) {
+		t.Fatalf("key watch not moved to 100: %+v", moved)
+	}
+	var copied PollWatchReply
+	nodes[1].pollWatch("prefix", 0, 0, &copied)
+	if len(copied.AlsoOn) != 1 || !EqualIds(copied.AlsoOn[0].Id, joining.Id) {
+		t.Errorf("prefix watch not copied to 100: %+v", copied)
+	}
+
+	// the new owner raises the events from now on
+	var reply KeyValueReply
+	if err := joining.DeleteLocal_Handler(&KeyValueReq{joining.Id, key, "", 0}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"key", "prefix"} {
+		var events PollWatchReply
+		joining.pollWatch(id, 0, 0, &events)
+		if len(events.Events) != 1 || events.Events[0].Type != WATCH_DELETE || events.Events[0].Key != key {
+			t.Errorf("%v watch on 100 got %v", id, events.Events)
+		}
+	}
+}
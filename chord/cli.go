@@ -3,14 +3,41 @@ package main
 import (
 	"./chord"
 	"bufio"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
-	"strconv"
 	"strings"
+	"time"
 )
 
+/* Exit codes of the non-interactive subcommands */
+const (
+	EXIT_OK    = 0 /* every command succeeded */
+	EXIT_FAIL  = 1 /* at least one command failed */
+	EXIT_USAGE = 2 /* bad flags, arguments or command file */
+)
+
+const USAGE = `usage:
+  cli [-count n] [-addr addr -id id] [-loglevel level] [-admin host] [-replicas n] [-idscheme s]
+      [-max-conns n] [-max-inflight n] [-max-inflight-peer n] [-rate r] [-rate-peer r] [-finger-candidates n]
+                                                                       start nodes, interactive prompt
+  cli get    -addr addr [-id id] [-json] [-consistency c] key          read a key from an existing ring
+  cli put    -addr addr [-id id] [-json] [-ttl d] [-consistency c] key value
+                                                                       write a key into an existing ring
+  cli delete -addr addr [-id id] [-json] [-consistency c] key          delete a key from an existing ring
+  cli batch  -addr addr [-id id] [-json] [-ttl d] [-file cmds]         run get/put/delete lines from a file (- for stdin)
+  cli export -addr addr [-id id] [-file out]                           write every key in the ring as JSON lines (- for stdout)
+  cli import -addr addr [-id id] [-file in]                            put every key of an export file (- for stdin)
+  cli certs  [-dir d] [-ids id,id,...] [-keys n]                       write a test CA, node and client certificates
+every command takes -tls-cert, -tls-key and -tls-ca to talk mutual TLS, a node's certificate sets its ID,
+-secret-file to sign requests with a cluster secret and -codec gob|json|binary to pick the wire encoding
+`
+
 func NodeStr(node *chord.Node) string {
 	var succ []byte
 	var pred []byte
@@ -24,27 +51,141 @@ func NodeStr(node *chord.Node) string {
 	return fmt.Sprintf("Node-%v: {succ:%v, pred:%v}", node.Id, succ, pred)
 }
 
+/* Split a command line into words, "double" or 'single' quotes group words with spaces */
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var cur []rune
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			cur = append(cur, r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur = append(cur, r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				args = append(args, string(cur))
+				cur = cur[:0]
+				inWord = false
+			}
+		default:
+			cur = append(cur, r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inWord {
+		args = append(args, string(cur))
+	}
+	return args, nil
+}
+
+/* RemoteNode for -addr/-id flags, the id defaults to the hash of the address like CreateNode does */
+func parseRemote(addr string, id string) (*chord.RemoteNode, error) {
+	remote := new(chord.RemoteNode)
+	remote.Addr = addr
+	if id == "" {
+		remote.Id = chord.HashKey(addr)
+		return remote, nil
+	}
+	var err error
+	remote.Id, err = chord.ParseId(id)
+	return remote, err
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "get", "put", "delete", "batch", "export", "import":
+			os.Exit(runSubcommand(os.Args[1], os.Args[2:]))
+		case "certs":
+			os.Exit(runCerts(os.Args[2:]))
+		}
+	}
+
 	countPtr := flag.Int("count", 1, "Total number of Chord nodes to start up in this process")
 	addrPtr := flag.String("addr", "", "Address of a node in the Chord ring you wish to join")
 	idPtr := flag.String("id", "", "ID of a node in the Chord ring you wish to join")
+	logPtr := flag.String("loglevel", "info", "Log level of the nodes: debug, info, warn, error or off")
+	adminPtr := flag.String("admin", "", "Host to serve each node's HTTP status endpoint on (e.g. localhost), port picked automatically")
+	replicasPtr := flag.Int("replicas", 1, "Copies of every key kept on consecutive nodes, 1 turns replication off")
+	tlsConfig := tlsFlags(flag.CommandLine)
+	secretPtr := flag.String("secret-file", "", "File holding the cluster secret every request is signed with")
+	codecPtr := flag.String("codec", "gob", "Wire encoding nodes use when calling each other: gob, json or binary")
+	maxConnsPtr := flag.Int("max-conns", 1024, "Incoming connections each node serves at once, 0 for no limit")
+	maxInFlightPtr := flag.Int("max-inflight", 512, "Requests each node handles at once, 0 for no limit")
+	maxInFlightPeerPtr := flag.Int("max-inflight-peer", 0, "Requests each node handles at once per remote host, 0 for no limit")
+	ratePtr := flag.Float64("rate", 0, "Requests per second each node accepts, 0 for no limit")
+	ratePeerPtr := flag.Float64("rate-peer", 0, "Requests per second each node accepts per remote host, 0 for no limit")
+	candidatesPtr := flag.Int("finger-candidates", 1, "Nodes kept per finger, lookups hop to the one with the lowest RTT")
+	schemePtr := flag.String("idscheme", "any", "How node IDs must be derived: any, address or key (of the TLS certificate)")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, USAGE)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	level, err := chord.ParseLogLevel(*logPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config := chord.DefaultConfig()
+	config.Logger = chord.NewLogger(os.Stderr, level)
+	config.Replicas = *replicasPtr
+	config.MaxConns = *maxConnsPtr
+	config.MaxInFlight = *maxInFlightPtr
+	config.MaxInFlightPerPeer = *maxInFlightPeerPtr
+	config.RequestRate = *ratePtr
+	config.RequestRatePerPeer = *ratePeerPtr
+	config.FingerCandidates = *candidatesPtr
+	config.TLS = tlsConfig()
+	if config.IdScheme, err = chord.ParseIdScheme(*schemePtr); err != nil {
+		log.Fatal(err)
+	}
+	codec, err := chord.ParseWireCodec(*codecPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	chord.UseWireCodec(codec)
+	if *secretPtr != "" {
+		if config.ClusterSecret, err = readSecret(*secretPtr); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if config.TLS != nil && *countPtr != 1 {
+		// the node ID comes from the certificate, one certificate makes one node
+		log.Fatal("-tls-cert starts a single node, -count must be 1")
+	}
+
 	var parent *chord.RemoteNode
 	if *addrPtr == "" {
 		parent = nil
 	} else {
-		parent = new(chord.RemoteNode)
-		val, _ := strconv.Atoi(*idPtr)
-		parent.Id = []byte{byte(val)}
-		parent.Addr = *addrPtr
+		parent, err = parseRemote(*addrPtr, *idPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
 		fmt.Printf("Attach this node to id:%v, addr:%v\n", parent.Id, parent.Addr)
 	}
 
-	var err error
 	nodes := make([]*chord.Node, *countPtr)
 	for i, _ := range nodes {
-		nodes[i], err = chord.CreateNode(parent)
+		nodes[i], err = chord.CreateNodeWithConfig(parent, nil, config)
 		if err != nil {
 			fmt.Println("Unable to create new node!")
 			log.Fatal(err)
@@ -53,14 +194,32 @@ func main() {
 			parent = nodes[i].RemoteSelf
 		}
 		fmt.Printf("Created -id %v -addr %v\n", chord.HashStr(nodes[i].Id), nodes[i].Addr)
+		if *adminPtr != "" {
+			listener, err := nodes[i].ServeAdmin(*adminPtr + ":0")
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("\tstatus endpoint http://%v/status\n", listener.Addr())
+		}
 	}
 
+	reader := bufio.NewReader(os.Stdin)
 	for {
-		fmt.Printf("quit|node|table|addr|data|get|put > ")
-		reader := bufio.NewReader(os.Stdin)
-		line, _ := reader.ReadString('\n')
-		line = strings.TrimSpace(line)
-		args := strings.SplitN(line, " ", 3)
+		fmt.Printf("quit|node|table|addr|data|get|put|check|dump > ")
+		line, readErr := reader.ReadString('\n')
+		args, err := splitArgs(strings.TrimSpace(line))
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if len(args) == 0 {
+			if readErr != nil {
+				// stdin closed, same as quit
+				args = []string{"quit"}
+			} else {
+				continue
+			}
+		}
 
 		switch args[0] {
 		case "node":
@@ -90,11 +249,40 @@ func main() {
 			}
 		case "put":
 			if len(args) > 2 {
-				err := chord.Put(nodes[0], args[1], args[2])
+				// unquoted trailing words all belong to the value
+				err := chord.Put(nodes[0], args[1], strings.Join(args[2:], " "))
 				if err != nil {
 					fmt.Println(err)
 				}
 			}
+		case "check":
+			report, err := chord.CheckRing(nodes[0].RemoteSelf)
+			if err != nil {
+				fmt.Println(err)
+			} else {
+				fmt.Print(report)
+			}
+		case "dump":
+			// dump [json|dot] [file]
+			snap, err := chord.SnapshotRing(nodes[0].RemoteSelf)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			var out []byte
+			if len(args) > 1 && args[1] == "dot" {
+				out = []byte(snap.DOT())
+			} else if out, err = snap.JSON(); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			if len(args) > 2 {
+				if err := ioutil.WriteFile(args[2], out, 0644); err != nil {
+					fmt.Println(err)
+				}
+			} else {
+				fmt.Println(string(out))
+			}
 		case "quit":
 			fmt.Println("goodbye")
 			for _, node := range nodes {
@@ -106,3 +294,289 @@ func main() {
 		}
 	}
 }
+
+
+/* Outcome of one get/put/delete, printed as a JSON line with -json */
+type cmdResult struct {
+	Cmd   string `json:"cmd"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+/*
+Non-interactive get/put/delete/batch/export/import against an existing ring
+
+we act as a thin chord.Client entering through the node given by
+-addr/-id, no local node joins the ring.
+*/
+func runSubcommand(name string, argv []string) int {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	addrPtr := fs.String("addr", "", "Address of any node in the Chord ring")
+	idPtr := fs.String("id", "", "ID of that node, defaults to the hash of -addr")
+	jsonPtr := fs.Bool("json", false, "Print one JSON object per command")
+	ttlPtr := fs.Duration("ttl", 0, "Expire put keys after this long (e.g. 30s), 0 never expires")
+	consistencyPtr := fs.String("consistency", "", "Replicas get/put/delete wait for: one, quorum or all. Unset talks to the owner only")
+	tlsConfig := tlsFlags(fs)
+	secretPtr := fs.String("secret-file", "", "File holding the cluster secret every request is signed with")
+	codecPtr := fs.String("codec", "gob", "Wire encoding to talk to the ring in: gob, json or binary")
+	filePtr := fs.String("file", "-", "Command file for batch or export file for export/import, - for stdin/stdout")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, USAGE)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(argv); err != nil {
+		return EXIT_USAGE
+	}
+	if *addrPtr == "" {
+		fmt.Fprintln(os.Stderr, "-addr is required")
+		return EXIT_USAGE
+	}
+	remote, err := parseRemote(*addrPtr, *idPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_USAGE
+	}
+	if config := tlsConfig(); config != nil {
+		if err := chord.UseTLS(config); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_USAGE
+		}
+	}
+	if *secretPtr != "" {
+		secret, err := readSecret(*secretPtr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_USAGE
+		}
+		chord.UseClusterSecret(secret)
+	}
+	codec, err := chord.ParseWireCodec(*codecPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_USAGE
+	}
+	chord.UseWireCodec(codec)
+	client := chord.NewClient(remote)
+	var level *chord.Consistency
+	if *consistencyPtr != "" {
+		parsed, err := chord.ParseConsistency(*consistencyPtr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_USAGE
+		}
+		level = &parsed
+	}
+
+	switch name {
+	case "export":
+		return runExport(remote, *filePtr)
+	case "import":
+		return runImport(client, *filePtr)
+	}
+
+	if name != "batch" {
+		args := append([]string{name}, fs.Args()...)
+		if err := checkCommand(args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_USAGE
+		}
+		if !printResult(runCommand(client, args, *ttlPtr, level), *jsonPtr) {
+			return EXIT_FAIL
+		}
+		return EXIT_OK
+	}
+
+	var in io.Reader = os.Stdin
+	if *filePtr != "-" {
+		file, err := os.Open(*filePtr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_USAGE
+		}
+		defer file.Close()
+		in = file
+	}
+
+	// parse everything up front so a typo does not leave half a batch applied
+	var cmds [][]string
+	scanner := bufio.NewScanner(in)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args, err := splitArgs(line)
+		if err == nil {
+			err = checkCommand(args)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "line %v: %v\n", lineNo, err)
+			return EXIT_USAGE
+		}
+		cmds = append(cmds, args)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_USAGE
+	}
+
+	code := EXIT_OK
+	for _, args := range cmds {
+		if !printResult(runCommand(client, args, *ttlPtr, level), *jsonPtr) {
+			code = EXIT_FAIL
+		}
+	}
+	return code
+}
+
+/* -tls-cert/-tls-key/-tls-ca on fs, the returned func gives nil unless -tls-cert was set */
+func tlsFlags(fs *flag.FlagSet) func() *chord.TLSConfig {
+	certPtr := fs.String("tls-cert", "", "PEM certificate for mutual TLS, a node's names its ID (see certs)")
+	keyPtr := fs.String("tls-key", "", "PEM private key of -tls-cert")
+	caPtr := fs.String("tls-ca", "", "PEM CA certificate peers must be signed by")
+	return func() *chord.TLSConfig {
+		if *certPtr == "" {
+			return nil
+		}
+		return &chord.TLSConfig{CertFile: *certPtr, KeyFile: *keyPtr, CAFile: *caPtr}
+	}
+}
+
+/* Cluster secret from file, surrounding whitespace is not part of it */
+func readSecret(file string) ([]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	secret := []byte(strings.TrimSpace(string(data)))
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("cluster secret in %v is empty", file)
+	}
+	return secret, nil
+}
+
+/* Write a test CA plus node and client certificates */
+func runCerts(argv []string) int {
+	fs := flag.NewFlagSet("certs", flag.ContinueOnError)
+	dirPtr := fs.String("dir", ".", "Directory to write the PEM files to")
+	idsPtr := fs.String("ids", "", "Comma separated node IDs to issue node certificates for")
+	keysPtr := fs.Int("keys", 0, "Node certificates to issue without an ID, for -idscheme key")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, USAGE)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(argv); err != nil {
+		return EXIT_USAGE
+	}
+	var ids [][]byte
+	for _, s := range strings.Split(*idsPtr, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		id, err := chord.ParseId(s)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_USAGE
+		}
+		ids = append(ids, id)
+	}
+	if err := chord.GenerateTestCertificates(*dirPtr, ids, *keysPtr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAIL
+	}
+	return EXIT_OK
+}
+
+/* Export the ring entered through remote to file */
+func runExport(remote *chord.RemoteNode, file string) int {
+	var out io.Writer = os.Stdout
+	if file != "-" {
+		f, err := os.Create(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_USAGE
+		}
+		defer f.Close()
+		out = f
+	}
+	count, err := chord.ExportRing(remote, out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export:", err)
+		return EXIT_FAIL
+	}
+	fmt.Fprintf(os.Stderr, "exported %v keys\n", count)
+	return EXIT_OK
+}
+
+/* Put every key of an export file */
+func runImport(client *chord.Client, file string) int {
+	var in io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_USAGE
+		}
+		defer f.Close()
+		in = f
+	}
+	count, err := chord.ImportRing(client, in)
+	fmt.Fprintf(os.Stderr, "imported %v keys\n", count)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "import:", err)
+		return EXIT_FAIL
+	}
+	return EXIT_OK
+}
+
+/* get key | put key value | delete key */
+func checkCommand(args []string) error {
+	switch {
+	case len(args) == 2 && (args[0] == "get" || args[0] == "delete"):
+		return nil
+	case len(args) == 3 && args[0] == "put":
+		return nil
+	}
+	return fmt.Errorf("expected \"get key\", \"put key value\" or \"delete key\", got %q", strings.Join(args, " "))
+}
+
+/* level is nil to read and write the owner only */
+func runCommand(client *chord.Client, args []string, ttl time.Duration, level *chord.Consistency) cmdResult {
+	res := cmdResult{Cmd: args[0], Key: args[1]}
+	var err error
+	switch {
+	case args[0] == "get" && level != nil:
+		res.Value, err = client.GetWithConsistency(args[1], *level)
+	case args[0] == "get":
+		res.Value, err = client.Get(args[1])
+	case args[0] == "put" && level != nil:
+		err = client.PutWithConsistency(args[1], args[2], ttl, *level)
+	case args[0] == "put":
+		err = client.PutWithTTL(args[1], args[2], ttl)
+	case args[0] == "delete" && level != nil:
+		err = client.DeleteWithConsistency(args[1], *level)
+	case args[0] == "delete":
+		err = client.Delete(args[1])
+	}
+	if err != nil {
+		res.Error = err.Error()
+	} else {
+		res.Ok = true
+	}
+	return res
+}
+
+/* Print res on stdout (errors on stderr unless -json), returns res.Ok */
+func printResult(res cmdResult, asJson bool) bool {
+	if asJson {
+		out, _ := json.Marshal(res)
+		fmt.Println(string(out))
+	} else if !res.Ok {
+		fmt.Fprintf(os.Stderr, "%v %v: %v\n", res.Cmd, res.Key, res.Error)
+	} else if res.Cmd == "get" {
+		fmt.Println(res.Value)
+	}
+	return res.Ok
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	for _, test := range []struct {
+		line string
+		args []string
+	}{
+		{"put k v", []string{"put", "k", "v"}},
+		{"  put\tk   v  ", []string{"put", "k", "v"}},
+		{`put k "two words"`, []string{"put", "k", "two words"}},
+		{`put k 'two words'`, []string{"put", "k", "two words"}},
+		{`put "a"b'c' v`, []string{"put", "abc", "v"}},
+		{`put k ""`, []string{"put", "k", ""}},
+		{`put k "say \"hi\""`, []string{"put", "k", `say "hi"`}},
+		{`put k 'back\slash'`, []string{"put", "k", `back\slash`}},
+		{`put k two\ words`, []string{"put", "k", "two words"}},
+		{`put k it\'s`, []string{"put", "k", "it's"}},
+		{"", nil},
+	} {
+		args, err := splitArgs(test.line)
+		if err != nil || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("splitArgs(%q) = %q, %v, want %q", test.line, args, err, test.args)
+		}
+	}
+
+	for _, line := range []string{`put k "open`, `put k 'open`, `put k v\`} {
+		if args, err := splitArgs(line); err == nil {
+			t.Errorf("splitArgs(%q) = %q, want an error", line, args)
+		}
+	}
+}